@@ -0,0 +1,528 @@
+package jsl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+)
+
+// Aggregate is a running summary of values kept in go, created in
+// javascript by the helpers count(), sum(), avg(), min(), max(),
+// percentile(p...), histogram(bounds) and topk(k), and the sketches in
+// sketch.go. Javascript sees the methods as add(x), value() and
+// merge(other), and JSON output holds the value.
+type Aggregate interface {
+	Add(x goja.Value)
+	Value() interface{}
+	Merge(other Aggregate) error
+}
+
+type aggregateHelper struct {
+	create func(args []goja.Value) (Aggregate, error)
+
+	// listArgs is true when the aggregate itself is configured with a
+	// list, it then needs one more argument to compute a list.
+	listArgs bool
+}
+
+var aggregateHelpers = map[string]aggregateHelper{
+	"count": {create: func(args []goja.Value) (Aggregate, error) {
+		return &countAggregate{}, nil
+	}},
+	"sum": {create: func(args []goja.Value) (Aggregate, error) {
+		return &sumAggregate{}, nil
+	}},
+	"avg": {create: func(args []goja.Value) (Aggregate, error) {
+		return &avgAggregate{}, nil
+	}},
+	"min": {create: func(args []goja.Value) (Aggregate, error) {
+		return &minMaxAggregate{max: false}, nil
+	}},
+	"max": {create: func(args []goja.Value) (Aggregate, error) {
+		return &minMaxAggregate{max: true}, nil
+	}},
+	"percentile": {create: newPercentileAggregate},
+	"histogram":  {create: newHistogramAggregate, listArgs: true},
+	"topk":       {create: newTopKAggregate},
+	"hll":        {create: newHLLAggregate},
+	"countmin":   {create: newCountMinAggregate},
+	"tdigest":    {create: newTDigestAggregate},
+}
+
+var aggregateType = reflect.TypeOf((*Aggregate)(nil)).Elem()
+
+// aggregateNameMapper gives the methods of aggregates javascript names,
+// add instead of Add, other go values keep their go names.
+type aggregateNameMapper struct{}
+
+func (aggregateNameMapper) FieldName(t reflect.Type, f reflect.StructField) string {
+	return f.Name
+}
+
+func (aggregateNameMapper) MethodName(t reflect.Type, m reflect.Method) string {
+	if !t.Implements(aggregateType) {
+		return m.Name
+	}
+
+	switch m.Name {
+	case "MarshalJSON", "String":
+		return ""
+	}
+
+	first, size := utf8.DecodeRuneInString(m.Name)
+	return string(unicode.ToLower(first)) + m.Name[size:]
+}
+
+// registerAggregates makes the aggregate helpers available in vm. Called
+// with a list first a helper returns the value for the list right away,
+// percentile([3, 1, 2], 50) is 2.
+func registerAggregates(vm *goja.Runtime) {
+	vm.SetFieldNameMapper(aggregateNameMapper{})
+
+	for name, helper := range aggregateHelpers {
+		name, helper := name, helper
+
+		vm.Set(name, func(call goja.FunctionCall) goja.Value {
+			args := call.Arguments
+
+			var list []interface{}
+			if len(args) > 0 && (!helper.listArgs || len(args) > 1) {
+				list, _ = args[0].Export().([]interface{})
+			}
+			if list != nil {
+				args = args[1:]
+			}
+
+			agg, err := helper.create(args)
+			if err != nil {
+				panic(vm.NewTypeError("%s: %s", name, err))
+			}
+
+			if list == nil {
+				return vm.ToValue(agg)
+			}
+
+			for _, x := range list {
+				agg.Add(vm.ToValue(x))
+			}
+			return vm.ToValue(agg.Value())
+		})
+	}
+}
+
+// aggregateNumber returns x as a number, values that are not numbers
+// (undefined, null, NaN) are skipped by the aggregates.
+func aggregateNumber(x goja.Value) (float64, bool) {
+	if x == nil || goja.IsUndefined(x) || goja.IsNull(x) {
+		return 0, false
+	}
+
+	f := x.ToFloat()
+	if math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// snapshotAggregates returns v with every aggregate in it replaced by
+// its value. Lists and objects holding an aggregate are copied, true is
+// returned when v changed.
+func snapshotAggregates(v interface{}) (interface{}, bool) {
+	switch value := v.(type) {
+	case Aggregate:
+		return value.Value(), true
+	case map[string]interface{}:
+		var snapshot map[string]interface{}
+		for key, item := range value {
+			item, changed := snapshotAggregates(item)
+			if !changed {
+				continue
+			}
+			if snapshot == nil {
+				snapshot = make(map[string]interface{}, len(value))
+				for key, item := range value {
+					snapshot[key] = item
+				}
+			}
+			snapshot[key] = item
+		}
+		if snapshot != nil {
+			return snapshot, true
+		}
+	case []interface{}:
+		var snapshot []interface{}
+		for n, item := range value {
+			item, changed := snapshotAggregates(item)
+			if !changed {
+				continue
+			}
+			if snapshot == nil {
+				snapshot = append([]interface{}(nil), value...)
+			}
+			snapshot[n] = item
+		}
+		if snapshot != nil {
+			return snapshot, true
+		}
+	}
+	return v, false
+}
+
+func mergeMismatch(a Aggregate, b Aggregate) error {
+	return fmt.Errorf("can't merge %T into %T", b, a)
+}
+
+func marshalAggregate(a Aggregate) ([]byte, error) {
+	return json.Marshal(a.Value())
+}
+
+func formatAggregate(a Aggregate) string {
+	data, err := json.Marshal(a.Value())
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// countAggregate counts add() calls.
+type countAggregate struct {
+	n int64
+}
+
+func (a *countAggregate) Add(x goja.Value) {
+	a.n += 1
+}
+
+func (a *countAggregate) Value() interface{} {
+	return a.n
+}
+
+func (a *countAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*countAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.n += b.n
+	return nil
+}
+
+func (a *countAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *countAggregate) String() string               { return formatAggregate(a) }
+
+type sumAggregate struct {
+	sum float64
+}
+
+func (a *sumAggregate) Add(x goja.Value) {
+	if f, ok := aggregateNumber(x); ok {
+		a.sum += f
+	}
+}
+
+func (a *sumAggregate) Value() interface{} {
+	return a.sum
+}
+
+func (a *sumAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*sumAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.sum += b.sum
+	return nil
+}
+
+func (a *sumAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *sumAggregate) String() string               { return formatAggregate(a) }
+
+// avgAggregate is the mean of the added values, null when there are none.
+type avgAggregate struct {
+	sum float64
+	n   int64
+}
+
+func (a *avgAggregate) Add(x goja.Value) {
+	if f, ok := aggregateNumber(x); ok {
+		a.sum += f
+		a.n += 1
+	}
+}
+
+func (a *avgAggregate) Value() interface{} {
+	if a.n == 0 {
+		return nil
+	}
+	return a.sum / float64(a.n)
+}
+
+func (a *avgAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*avgAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.sum += b.sum
+	a.n += b.n
+	return nil
+}
+
+func (a *avgAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *avgAggregate) String() string               { return formatAggregate(a) }
+
+// minMaxAggregate is the smallest or, with max, the largest value added,
+// null when there are none.
+type minMaxAggregate struct {
+	max   bool
+	best  float64
+	found bool
+}
+
+func (a *minMaxAggregate) Add(x goja.Value) {
+	f, ok := aggregateNumber(x)
+	if !ok {
+		return
+	}
+
+	if !a.found || (a.max && f > a.best) || (!a.max && f < a.best) {
+		a.best = f
+		a.found = true
+	}
+}
+
+func (a *minMaxAggregate) Value() interface{} {
+	if !a.found {
+		return nil
+	}
+	return a.best
+}
+
+func (a *minMaxAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*minMaxAggregate)
+	if !ok || a.max != b.max {
+		return mergeMismatch(a, other)
+	}
+	if b.found {
+		if !a.found || (a.max && b.best > a.best) || (!a.max && b.best < a.best) {
+			a.best = b.best
+			a.found = true
+		}
+	}
+	return nil
+}
+
+func (a *minMaxAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *minMaxAggregate) String() string               { return formatAggregate(a) }
+
+// percentileAggregate keeps every value to give exact percentiles,
+// interpolated between the closest ranks. A single percentile is a
+// number, several are an object keyed by p50, p99.9 and so on.
+type percentileAggregate struct {
+	percents []float64
+	values   []float64
+	sorted   bool
+}
+
+func newPercentileAggregate(args []goja.Value) (Aggregate, error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected at least one percentile")
+	}
+
+	a := &percentileAggregate{}
+	for _, arg := range args {
+		p, ok := aggregateNumber(arg)
+		if !ok || p < 0 || p > 100 {
+			return nil, fmt.Errorf("percentile %s is not between 0 and 100", arg)
+		}
+		a.percents = append(a.percents, p)
+	}
+	return a, nil
+}
+
+func (a *percentileAggregate) Add(x goja.Value) {
+	if f, ok := aggregateNumber(x); ok {
+		a.values = append(a.values, f)
+		a.sorted = false
+	}
+}
+
+func (a *percentileAggregate) Percentile(p float64) interface{} {
+	if len(a.values) == 0 {
+		return nil
+	}
+
+	if !a.sorted {
+		sort.Float64s(a.values)
+		a.sorted = true
+	}
+
+	rank := p / 100 * float64(len(a.values)-1)
+	low := int(math.Floor(rank))
+	high := int(math.Ceil(rank))
+
+	return a.values[low] + (a.values[high]-a.values[low])*(rank-float64(low))
+}
+
+func (a *percentileAggregate) Value() interface{} {
+	if len(a.percents) == 1 {
+		return a.Percentile(a.percents[0])
+	}
+
+	result := make(map[string]interface{}, len(a.percents))
+	for _, p := range a.percents {
+		result["p"+strconv.FormatFloat(p, 'f', -1, 64)] = a.Percentile(p)
+	}
+	return result
+}
+
+func (a *percentileAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*percentileAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.values = append(a.values, b.values...)
+	a.sorted = false
+	return nil
+}
+
+func (a *percentileAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *percentileAggregate) String() string               { return formatAggregate(a) }
+
+// histogramAggregate counts values per bucket, a value goes in the
+// first bucket with a bound (le) it is less than or equal to. Values
+// above every bound are counted in a last +Inf bucket.
+type histogramAggregate struct {
+	bounds []float64
+	counts []int64
+}
+
+func newHistogramAggregate(args []goja.Value) (Aggregate, error) {
+	var bounds []interface{}
+	if len(args) > 0 {
+		bounds, _ = args[0].Export().([]interface{})
+	}
+	if len(bounds) == 0 {
+		return nil, errors.New("expected a list of bucket bounds")
+	}
+
+	a := &histogramAggregate{counts: make([]int64, len(bounds)+1)}
+	for _, bound := range bounds {
+		f, ok := bound.(float64)
+		if n, isInt := bound.(int64); isInt {
+			f, ok = float64(n), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("bucket bound %v is not a number", bound)
+		}
+		a.bounds = append(a.bounds, f)
+	}
+
+	if !sort.Float64sAreSorted(a.bounds) {
+		return nil, errors.New("bucket bounds must be in increasing order")
+	}
+	return a, nil
+}
+
+func (a *histogramAggregate) Add(x goja.Value) {
+	f, ok := aggregateNumber(x)
+	if !ok {
+		return
+	}
+	a.counts[sort.SearchFloat64s(a.bounds, f)] += 1
+}
+
+func (a *histogramAggregate) Value() interface{} {
+	result := make([]interface{}, 0, len(a.counts))
+	for n, count := range a.counts {
+		var le interface{} = "+Inf"
+		if n < len(a.bounds) {
+			le = a.bounds[n]
+		}
+		result = append(result, map[string]interface{}{"le": le, "count": count})
+	}
+	return result
+}
+
+func (a *histogramAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*histogramAggregate)
+	if !ok || !reflect.DeepEqual(a.bounds, b.bounds) {
+		return mergeMismatch(a, other)
+	}
+	for n := range a.counts {
+		a.counts[n] += b.counts[n]
+	}
+	return nil
+}
+
+func (a *histogramAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *histogramAggregate) String() string               { return formatAggregate(a) }
+
+// topKAggregate counts every distinct value (as a string) and gives the
+// K most frequent as a list of {key, count}.
+type topKAggregate struct {
+	k      int
+	counts map[string]int64
+}
+
+func newTopKAggregate(args []goja.Value) (Aggregate, error) {
+	k := 10
+	if len(args) > 0 {
+		f, ok := aggregateNumber(args[0])
+		if !ok || f < 1 {
+			return nil, fmt.Errorf("k %s is not a positive number", args[0])
+		}
+		k = int(f)
+	}
+	return &topKAggregate{k: k, counts: make(map[string]int64)}, nil
+}
+
+func (a *topKAggregate) Add(x goja.Value) {
+	if x == nil || goja.IsUndefined(x) || goja.IsNull(x) {
+		return
+	}
+	a.counts[x.String()] += 1
+}
+
+func (a *topKAggregate) Value() interface{} {
+	keys := make([]string, 0, len(a.counts))
+	for key := range a.counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if a.counts[keys[i]] != a.counts[keys[j]] {
+			return a.counts[keys[i]] > a.counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) > a.k {
+		keys = keys[:a.k]
+	}
+
+	result := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, map[string]interface{}{"key": key, "count": a.counts[key]})
+	}
+	return result
+}
+
+func (a *topKAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*topKAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	for key, count := range b.counts {
+		a.counts[key] += count
+	}
+	return nil
+}
+
+func (a *topKAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *topKAggregate) String() string               { return formatAggregate(a) }
@@ -0,0 +1,171 @@
+package jsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+func TestAggregates(t *testing.T) {
+	var output bytes.Buffer
+	enc := json.NewEncoder(&output)
+
+	iter, err := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			enc.Encode(i.(goja.Value).Export())
+		},
+		Pre: `{n: count(), total: sum(), mean: avg(), low: min(), high: max(), empty: avg(),
+			p: percentile(50, 75), h: histogram([2, 5]), top: topk(2)}`,
+		Accumulator: `accum.n.add(); accum.total.add(i.v); accum.mean.add(i.v); accum.low.add(i.v);
+			accum.high.add(i.v); accum.p.add(i.v); accum.h.add(i.v); accum.top.add(i.k)`,
+		Iter: "undefined",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %s", err)
+	}
+
+	rows := []string{
+		`{"v": 1, "k": "a"}`,
+		`{"v": 4, "k": "b"}`,
+		`{"v": 2, "k": "a"}`,
+		`{"v": 10, "k": "c"}`,
+		`{"k": "b"}`,
+		`{"v": 3, "k": "a"}`,
+	}
+
+	iter.PreIteration()
+	for _, line := range rows {
+		row, _ := LoadLine(line)
+		if err := iter.IterFunc(row); err != nil {
+			t.Fatalf("Iteration failed: %s", err)
+		}
+	}
+	iter.PostIteration()
+
+	expected := `{"empty":null,"h":[{"count":2,"le":2},{"count":2,"le":5},{"count":1,"le":"+Inf"}],` +
+		`"high":10,"low":1,"mean":4,"n":6,"p":{"p50":3,"p75":4},` +
+		`"top":[{"count":3,"key":"a"},{"count":2,"key":"b"}],"total":20}` + "\n"
+
+	if output.String() != expected {
+		t.Errorf("Aggregates incorrect:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestAggregates_List(t *testing.T) {
+	iter, _ := NewIterator(&IterConfig{})
+
+	cases := map[string]interface{}{
+		"percentile([5, 1, 3, 2, 4], 50)":               int64(3),
+		"sum([1, 2, null, 3])":                          int64(6),
+		"avg([1, 2])":                                   float64(1.5),
+		"count([1, 2, 3])":                              int64(3),
+		"max([])":                                       nil,
+		"topk(['x', 'y', 'x'], 1)[0].key":               "x",
+		"histogram([1, 7], [5])[1].count":               int64(1),
+		"String(percentile(99))":                        "null",
+		"JSON.stringify({s: sum([1.5, 1])})":            `{"s":2.5}`,
+		"typeof sum().add":                              "function",
+		"typeof sum().sum":                              "undefined",
+		"var m = min(); m.add(3); m.add(-1); m.value()": int64(-1),
+		"var c = count(); var d = count(); d.add(); c.merge(d); c.value()": int64(1),
+	}
+
+	for code, expected := range cases {
+		value, err := iter.RunString(code)
+		if err != nil {
+			t.Errorf("%s failed: %s", code, err)
+			continue
+		}
+
+		if value.Export() != expected {
+			t.Errorf("%s = %#v, expected %#v", code, value.Export(), expected)
+		}
+	}
+
+	for _, code := range []string{"percentile()", "percentile(101)", "histogram([5, 1])", "topk(0)", "sum().merge(count())", "count().merge(count([1]))"} {
+		if _, err := iter.RunString(code); err == nil {
+			t.Errorf("Expected %s to fail.", code)
+		}
+	}
+}
+
+func TestHandleParallel_Aggregates(t *testing.T) {
+	var results []interface{}
+
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 100; i += 1 {
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).Export())
+		},
+		Pre:         "{p: percentile(99), groups: 0}",
+		Accumulator: "accum.p.add(i.I)",
+		Group:       "i.I % 2",
+		Post:        "accum.p.value()",
+		Iter:        "undefined",
+	}, ParallelConfig{Workers: 4, FailOnError: true}, input)
+
+	if err != nil {
+		t.Fatalf("Parallel iteration failed: %s", err)
+	}
+
+	if len(results) != 2 || results[0] != float64(97.02) || results[1] != float64(98.02) {
+		t.Errorf("Merged percentiles incorrect: %v", results)
+	}
+}
+
+func TestHandleParallel_EmitAggregates(t *testing.T) {
+	// Results are written on another goroutine while the accumulator
+	// keeps adding to its aggregates, run with -race.
+	output := make(chan interface{})
+	done := make(chan int)
+	go func() {
+		emitted := 0
+		for result := range output {
+			if _, err := json.Marshal(result); err != nil {
+				t.Errorf("Failed to encode %v: %s", result, err)
+			}
+			emitted += 1
+		}
+		done <- emitted
+	}()
+
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 1000; i += 1 {
+			if i%100 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i}}
+		}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			output <- ExportValue(i)
+		},
+		Pre:         "{top: topk(3), p: percentile(50, 99), all: [count()]}",
+		Accumulator: "accum.top.add(i.I % 50); accum.p.add(i.I); accum.all[0].add()",
+		Post:        "accum",
+		Iter:        "undefined",
+	}, ParallelConfig{Workers: 1, FailOnError: true, EmitEvery: time.Millisecond}, input)
+	close(output)
+
+	if err != nil {
+		t.Fatalf("Iteration failed: %s", err)
+	}
+
+	if emitted := <-done; emitted < 2 {
+		t.Errorf("Expected results while iterating, got %d", emitted)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dop251/goja"
 )
@@ -201,8 +204,349 @@ func TestIterator_WithAccum(t *testing.T) {
 	}
 }
 
-// func BenchmarkHello(b *testing.B) {
-// 	for i := 0; i < b.N; i++ {
+func TestIterator_WithGroup(t *testing.T) {
+	var results []interface{} = []interface{}{}
+
+	config := &IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).Export())
+		},
+		Pre:         "{count:0}",
+		Post:        "key + '=' + accum.count",
+		Accumulator: "accum.count+=i.Double",
+		Group:       "i.I % 3 == 0 ? 'three' : (i.I % 2 == 0 ? 'even' : undefined)",
+		Iter:        "undefined",
+	}
+
+	iter, _ := NewIterator(config)
+	iter.PreIteration()
+
+	for i := 0; i < 10; i += 1 {
+		err := iter.IterFunc(InputObject{I: i, Double: i * 2})
+		if err != nil {
+			t.Errorf("iteration failed: %s", err)
+		}
+	}
+
+	iter.PostIteration()
+
+	if !reflect.DeepEqual(results, []interface{}{"three=36", "even=28"}) {
+		t.Errorf("Group post incorrect: %v", results)
+	}
 
-// 	}
-// }
+	// Without post the map of all groups is emitted.
+	results = []interface{}{}
+	config.Post = ""
+
+	iter, _ = NewIterator(config)
+	iter.PreIteration()
+	iter.IterFunc(InputObject{I: 3, Double: 6})
+	iter.IterFunc(InputObject{I: 4, Double: 8})
+	iter.PostIteration()
+
+	expected := map[string]interface{}{
+		"three": map[string]interface{}{"count": int64(6)},
+		"even":  map[string]interface{}{"count": int64(8)},
+	}
+	if len(results) != 1 || !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("Group map incorrect: %v", results)
+	}
+}
+
+func TestHandleParallel_Group(t *testing.T) {
+	var results []string
+
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 100; i += 1 {
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).String())
+		},
+		Pre:         "{count:0}",
+		Accumulator: "accum.count+=1",
+		Merge:       "{count: a.count+b.count}",
+		Group:       "i.I % 4",
+		Post:        "key + '=' + accum.count",
+		Iter:        "undefined",
+	}, ParallelConfig{Workers: 3, FailOnError: true}, input)
+
+	if err != nil {
+		t.Errorf("Parallel iteration failed: %s", err)
+	}
+
+	sort.Strings(results)
+	if !reflect.DeepEqual(results, []string{"0=25", "1=25", "2=25", "3=25"}) {
+		t.Errorf("Merged groups incorrect: %v", results)
+	}
+}
+
+func TestHandleParallel_Merge(t *testing.T) {
+	var results []interface{} = []interface{}{}
+
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 100; i += 1 {
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i)
+		},
+		Pre:         "{count:0, sum:0}",
+		Accumulator: "accum.count+=1; accum.sum+=i.I",
+		Merge:       "{count: a.count+b.count, sum: a.sum+b.sum}",
+		Post:        "accum.sum / accum.count",
+	}, ParallelConfig{Workers: 4, FailOnError: true}, input)
+
+	if err != nil {
+		t.Errorf("Parallel iteration failed: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Incorrect result length.")
+	}
+
+	if results[0].(goja.Value).ToFloat() != 49.5 {
+		t.Errorf("Merged accumulator incorrect: %v", results[0])
+	}
+}
+
+func TestHandleParallel_DefaultMerge(t *testing.T) {
+	var results []interface{} = []interface{}{}
+
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 100; i += 1 {
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i)
+		},
+		Pre:         "{count:0, evens:[]}",
+		Accumulator: "accum.count+=1; if (i.I%10==0) { accum.evens.push(i.I) }",
+	}, ParallelConfig{Workers: 3, FailOnError: true}, input)
+
+	if err != nil {
+		t.Errorf("Parallel iteration failed: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Incorrect result length.")
+	}
+
+	var target struct {
+		Count int
+		Evens []int
+	}
+	if err := GojaValueToStruct(results[0].(*goja.Object), &target); err != nil {
+		t.Fatalf("Goja value coerce failure: %s", err)
+	}
+
+	if target.Count != 100 || len(target.Evens) != 10 {
+		t.Errorf("Default merge incorrect: %+v", target)
+	}
+}
+
+func TestHandleParallel_Ordered(t *testing.T) {
+	var results []interface{} = []interface{}{}
+
+	raw := make(chan Record)
+	input := make(chan Record)
+	go func() {
+		for i := 0; i < 1000; i += 1 {
+			raw <- Record{Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(raw)
+	}()
+	go Sequence(raw, input)
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i)
+		},
+		Filter: "i.I % 3 != 0",
+		Iter:   "i.I",
+	}, ParallelConfig{Workers: 4, FailOnError: true, Ordered: true, ReorderSize: 8}, input)
+
+	if err != nil {
+		t.Errorf("Parallel iteration failed: %s", err)
+	}
+
+	if len(results) != 666 {
+		t.Fatalf("Incorrect result length %d.", len(results))
+	}
+
+	var last int64 = -1
+	for _, r := range results {
+		v := r.(int64)
+		if v <= last {
+			t.Fatalf("Results out of order: %d after %d", v, last)
+		}
+		last = v
+	}
+}
+
+func TestHandleParallel_EmitEvery(t *testing.T) {
+	var results []interface{} = []interface{}{}
+
+	input := make(chan Record)
+	go func() {
+		input <- Record{Value: InputObject{I: 1}}
+		input <- Record{Value: InputObject{I: 2}}
+		time.Sleep(100 * time.Millisecond)
+		input <- Record{Value: InputObject{I: 3}}
+		close(input)
+	}()
+
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i)
+		},
+		Pre:         "{sum:0}",
+		Accumulator: "accum.sum+=i.I",
+		Post:        "accum.sum",
+	}, ParallelConfig{Workers: 1, FailOnError: true, EmitEvery: 40 * time.Millisecond}, input)
+
+	if err != nil {
+		t.Errorf("Iteration failed: %s", err)
+	}
+
+	if len(results) < 2 {
+		t.Fatalf("Expected periodic results, got %v", results)
+	}
+
+	if results[0].(goja.Value).ToInteger() != 3 {
+		t.Errorf("First emit incorrect: %v", results[0])
+	}
+
+	if results[len(results)-1].(goja.Value).ToInteger() != 6 {
+		t.Errorf("Final post incorrect: %v", results[len(results)-1])
+	}
+
+	err = HandleParallel(&IterConfig{}, ParallelConfig{Workers: 2, EmitEvery: time.Second}, input)
+	if err == nil {
+		t.Errorf("Expected an error for emit every with several workers.")
+	}
+}
+
+var benchmarkRows []interface{}
+
+// loadBenchmarkRows parses a 1M line input once for the benchmarks.
+func loadBenchmarkRows(b *testing.B) []interface{} {
+	if benchmarkRows == nil {
+		for i := 0; i < 1000000; i += 1 {
+			row, err := LoadLine(fmt.Sprintf(`{"i": %d, "double": %d, "name": "row%d"}`, i, i*2, i))
+			if err != nil {
+				b.Fatalf("Failed to parse json: %s", err)
+			}
+			benchmarkRows = append(benchmarkRows, row)
+		}
+	}
+	return benchmarkRows
+}
+
+var benchmarkConfig = IterConfig{
+	Emitter:     func(i interface{}) {},
+	Filter:      "i.i % 2 == 0",
+	Iter:        "i.double",
+	Pre:         "{count:0}",
+	Accumulator: "accum.count+=1",
+}
+
+// BenchmarkRunStringPerRow is the baseline of setting globals and
+// parsing a call with RunString for every stage of every row.
+func BenchmarkRunStringPerRow(b *testing.B) {
+	rows := loadBenchmarkRows(b)
+	config := benchmarkConfig
+	iter, err := NewIterator(&config)
+	if err != nil {
+		b.Fatalf("Failed to create iterator.")
+	}
+	iter.PreIteration()
+	vm := iter.VM
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, row := range rows {
+			vm.Set("i", row)
+			vm.Set("accum", iter.Accumulator)
+			keep, err := vm.RunString("filter(i, accum)")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if keep.ToBoolean() == false {
+				continue
+			}
+			if _, err := vm.RunString("iter(i, accum)"); err != nil {
+				b.Fatal(err)
+			}
+			if iter.Accumulator, err = vm.RunString("accumulator(i, accum)"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkIterFunc(b *testing.B) {
+	rows := loadBenchmarkRows(b)
+	config := benchmarkConfig
+	iter, err := NewIterator(&config)
+	if err != nil {
+		b.Fatalf("Failed to create iterator.")
+	}
+	iter.PreIteration()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, row := range rows {
+			if err := iter.IterFunc(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestIterator_GroupInheritedKeys(t *testing.T) {
+	var results []interface{}
+
+	iter, err := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).Export())
+		},
+		Pre:         "{n: 0}",
+		Post:        "key + '=' + accum.n",
+		Accumulator: "accum.n += 1",
+		Group:       "i.k",
+		Iter:        "undefined",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %s", err)
+	}
+
+	iter.PreIteration()
+	for _, key := range []string{"toString", "a", "constructor", "__proto__", "toString", "hasOwnProperty"} {
+		if err := iter.IterFunc(map[string]interface{}{"k": key}); err != nil {
+			t.Fatalf("Iteration failed: %s", err)
+		}
+	}
+	iter.PostIteration()
+
+	sort.Slice(results, func(a, b int) bool { return results[a].(string) < results[b].(string) })
+	expected := []interface{}{"__proto__=1", "a=1", "constructor=1", "hasOwnProperty=1", "toString=2"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Groups incorrect: %v", results)
+	}
+}
@@ -0,0 +1,189 @@
+package jsl
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrorBudget is how many errors iteration tolerates before giving up,
+// the zero value tolerates any number.
+type ErrorBudget struct {
+	// MaxErrors stops iteration at the first error past this many.
+	MaxErrors int
+
+	// MaxErrorRate stops iteration once more than this share of rows
+	// failed, checked after MinRows rows and again at the end.
+	MaxErrorRate float64
+	MinRows      int
+}
+
+const DEFAULT_ERROR_RATE_MIN_ROWS = 100
+
+func (eb ErrorBudget) Enabled() bool {
+	return eb.MaxErrors > 0 || eb.MaxErrorRate > 0
+}
+
+// BudgetError is returned when iteration ran out of its error budget.
+type BudgetError struct {
+	Errors int
+	Rows   int
+	Last   error
+}
+
+func (e *BudgetError) Error() string {
+	rate := 0.0
+	if e.Rows > 0 {
+		rate = float64(e.Errors) / float64(e.Rows) * 100
+	}
+
+	return fmt.Sprintf("error budget exceeded: %d errors in %d rows (%.1f%%), last error: %s", e.Errors, e.Rows, rate, e.Last)
+}
+
+func (e *BudgetError) Unwrap() error {
+	return e.Last
+}
+
+// ErrorHandler decides what happens to the errors of a run: they are
+// passed to OnError, counted against the budget and stop the run with
+// FailOnError or once the budget runs out. It is safe to share between
+// the workers and whoever writes their results.
+type ErrorHandler struct {
+	failOnError bool
+	onError     func(error)
+	stats       *Stats
+	counter     *errorCounter
+
+	once sync.Once
+	err  error
+	quit chan bool
+}
+
+// NewErrorHandler handles errors as set by the FailOnError, Budget and
+// OnError of pc, and counts them in stats.
+func NewErrorHandler(pc ParallelConfig, stats *Stats) *ErrorHandler {
+	return &ErrorHandler{
+		failOnError: pc.FailOnError,
+		onError:     pc.OnError,
+		stats:       stats,
+		counter:     newErrorCounter(pc.Budget),
+		quit:        make(chan bool),
+	}
+}
+
+// Handle reports err and returns false when the run should stop.
+func (h *ErrorHandler) Handle(err error) bool {
+	h.stats.Error(err)
+	if h.onError != nil {
+		h.onError(err)
+	}
+
+	if h.failOnError {
+		h.stop(err)
+		return false
+	}
+
+	if exceeded := h.counter.failed(err); exceeded != nil {
+		h.stop(exceeded)
+		return false
+	}
+
+	if h.onError == nil {
+		log.Println("debug", err)
+	}
+	return true
+}
+
+// Err returns the error that stopped the run, or a BudgetError when too
+// many of all the rows failed. It is meant for once the run is over.
+func (h *ErrorHandler) Err() error {
+	if err := h.stopped(); err != nil {
+		return err
+	}
+	return h.counter.done()
+}
+
+func (h *ErrorHandler) row() {
+	h.counter.row()
+}
+
+func (h *ErrorHandler) stop(err error) {
+	h.once.Do(func() {
+		h.err = err
+		close(h.quit)
+	})
+}
+
+// stopped returns the error that stopped the run, nil while it goes on.
+func (h *ErrorHandler) stopped() error {
+	select {
+	case <-h.quit:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// errorCounter counts rows and errors against a budget, it is shared by
+// parallel workers.
+type errorCounter struct {
+	budget ErrorBudget
+
+	mu     sync.Mutex
+	rows   int
+	errors int
+	last   error
+}
+
+func newErrorCounter(budget ErrorBudget) *errorCounter {
+	if budget.MinRows == 0 {
+		budget.MinRows = DEFAULT_ERROR_RATE_MIN_ROWS
+	}
+	return &errorCounter{budget: budget}
+}
+
+func (ec *errorCounter) row() {
+	ec.mu.Lock()
+	ec.rows += 1
+	ec.mu.Unlock()
+}
+
+// failed counts err and returns a BudgetError when the budget ran out.
+func (ec *errorCounter) failed(err error) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.errors += 1
+	ec.last = err
+
+	if ec.budget.MaxErrors > 0 && ec.errors > ec.budget.MaxErrors {
+		return ec.exceeded()
+	}
+
+	if ec.rows >= ec.budget.MinRows && ec.overRate() {
+		return ec.exceeded()
+	}
+	return nil
+}
+
+// done checks the error rate over every row, once iteration is over.
+func (ec *errorCounter) done() error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.overRate() {
+		return ec.exceeded()
+	}
+	return nil
+}
+
+func (ec *errorCounter) overRate() bool {
+	if ec.budget.MaxErrorRate <= 0 || ec.errors == 0 {
+		return false
+	}
+	return float64(ec.errors) > ec.budget.MaxErrorRate*float64(ec.rows)
+}
+
+func (ec *errorCounter) exceeded() error {
+	return &BudgetError{Errors: ec.errors, Rows: ec.rows, Last: ec.last}
+}
@@ -0,0 +1,130 @@
+package jsl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorCounter(t *testing.T) {
+	counter := newErrorCounter(ErrorBudget{MaxErrors: 2})
+	for n := 0; n < 2; n += 1 {
+		counter.row()
+		if err := counter.failed(errors.New("bad row")); err != nil {
+			t.Fatalf("Error %d should be in budget: %s", n, err)
+		}
+	}
+
+	err := counter.failed(errors.New("last row"))
+	budgetErr, ok := err.(*BudgetError)
+	if !ok || budgetErr.Errors != 3 || budgetErr.Rows != 2 || budgetErr.Last.Error() != "last row" {
+		t.Errorf("Expected the budget to run out, got %v", err)
+	}
+
+	counter = newErrorCounter(ErrorBudget{MaxErrorRate: 0.1, MinRows: 10})
+	for n := 0; n < 5; n += 1 {
+		counter.row()
+	}
+	if err := counter.failed(errors.New("early")); err != nil {
+		t.Errorf("Rate should not be checked before MinRows: %s", err)
+	}
+
+	for n := 0; n < 15; n += 1 {
+		counter.row()
+	}
+	if err := counter.failed(errors.New("second")); err != nil {
+		t.Errorf("2 errors in 20 rows is in budget: %s", err)
+	}
+	if err := counter.failed(errors.New("third")); err == nil {
+		t.Errorf("3 errors in 20 rows is over budget")
+	}
+
+	counter = newErrorCounter(ErrorBudget{MaxErrorRate: 0.1})
+	counter.row()
+	counter.failed(errors.New("only row"))
+	if err := counter.done(); err == nil {
+		t.Errorf("Rate should be checked at the end")
+	}
+}
+
+func TestHandleParallel_Budget(t *testing.T) {
+	run := func(budget ErrorBudget) error {
+		// Buffered so the rows left over after a stop are not blocked.
+		input := make(chan Record, 200)
+		for i := 0; i < 200; i += 1 {
+			input <- Record{Seq: uint64(i), Value: InputObject{I: i, Double: i * 2}}
+		}
+		close(input)
+
+		return HandleParallel(&IterConfig{
+			Emitter: func(i interface{}) {},
+			Iter:    "i.I % 10 == 0 ? i.missing.value : i",
+		}, ParallelConfig{Workers: 4, Budget: budget, OnError: func(error) {}}, input)
+	}
+
+	if err := run(ErrorBudget{MaxErrors: 20, MaxErrorRate: 0.2}); err != nil {
+		t.Errorf("20 errors should be in budget: %s", err)
+	}
+
+	var budgetErr *BudgetError
+	if err := run(ErrorBudget{MaxErrors: 5}); !errors.As(err, &budgetErr) || budgetErr.Errors != 6 {
+		t.Errorf("Expected to stop at the 6th error, got %v", err)
+	}
+
+	if err := run(ErrorBudget{MaxErrorRate: 0.05}); !errors.As(err, &budgetErr) {
+		t.Errorf("Expected to stop on the error rate, got %v", err)
+	}
+}
+
+func TestHandleChannel_Budget(t *testing.T) {
+	iter, _ := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {},
+		Iter:    "i.a.b",
+	})
+
+	input := make(chan interface{}, 3)
+	input <- map[string]interface{}{"a": map[string]interface{}{"b": 1}}
+	input <- map[string]interface{}{}
+	input <- map[string]interface{}{}
+	close(input)
+
+	err := iter.HandleChannelBudget(input, false, ErrorBudget{MaxErrors: 1})
+
+	var stageErr *StageError
+	if _, ok := err.(*BudgetError); !ok || !errors.As(err, &stageErr) || stageErr.Stage != "iter" {
+		t.Errorf("Expected a budget error wrapping the iter error, got %v", err)
+	}
+}
+
+func TestErrorHandler_Shared(t *testing.T) {
+	run_stats := NewStats()
+	var handled []error
+	pc := ParallelConfig{Workers: 1, Budget: ErrorBudget{MaxErrors: 1}, OnError: func(err error) { handled = append(handled, err) }}
+	handler := NewErrorHandler(pc, run_stats)
+	pc.Errors = handler
+
+	// An error of a result written outside the workers counts against the
+	// same budget.
+	if !handler.Handle(&StageError{Stage: "output", Err: errors.New("unsupported value")}) {
+		t.Fatalf("The first error should be in budget")
+	}
+
+	input := make(chan Record, 2)
+	input <- Record{Seq: 0, Value: map[string]interface{}{}}
+	input <- Record{Seq: 1, Value: map[string]interface{}{}}
+	close(input)
+
+	err := HandleParallel(&IterConfig{Emitter: func(i interface{}) {}, Iter: "i.a.b", Stats: run_stats}, pc, input)
+
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) || budgetErr.Errors != 2 || handler.Err() != err {
+		t.Errorf("Expected the budget to run out at the iter error, got %v", err)
+	}
+
+	if len(handled) != 2 {
+		t.Errorf("Expected both errors passed to OnError, got %v", handled)
+	}
+
+	if stage := run_stats.Report().Stages["output"]; stage.Errors != 1 {
+		t.Errorf("Wrong output stage stats: %+v", stage)
+	}
+}
@@ -0,0 +1,97 @@
+package jsl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// Decompress detects gzip, zstd and bzip2 input by its magic bytes and
+// returns a reader of the decompressed stream, any other input is
+// returned as is. Closing the result does not close r.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+
+	// Only input that starts like a magic number waits for the rest of
+	// it, so the first line of a live stream is not held back. Peek
+	// returns what is available when the input is shorter.
+	magic, _ := buffered.Peek(1)
+	if len(magic) == 1 && (magic[0] == gzipMagic[0] || magic[0] == zstdMagic[0] || magic[0] == bzip2Magic[0]) {
+		magic, _ = buffered.Peek(4)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		dec, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, bzip2Magic) && len(magic) == 4 && magic[3] >= '1' && magic[3] <= '9':
+		return io.NopCloser(bzip2.NewReader(buffered)), nil
+	}
+
+	return io.NopCloser(buffered), nil
+}
+
+// CompressionFromFilename returns the compression implied by the
+// extension of filename, "" when there is none.
+func CompressionFromFilename(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(filename, ".zst"):
+		return "zstd"
+	}
+	return ""
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compress returns a writer that compresses to w with method, gzip or
+// zstd ("" or "none" writes as is). Close must be called to finish the
+// stream, it does not close w.
+//
+// Both formats allow streams to be concatenated, so compressed output
+// can be appended to an existing file.
+func Compress(w io.Writer, method string) (io.WriteCloser, error) {
+	switch method {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip", "gz":
+		return gzip.NewWriter(w), nil
+	case "zstd", "zst":
+		return zstd.NewWriter(w)
+	}
+
+	return nil, fmt.Errorf("unknown compression %s", method)
+}
+
+// FlushCompressed writes out what a writer returned by Compress holds
+// back, so a reader of w sees every complete record written so far.
+func FlushCompressed(w io.Writer) error {
+	if flusher, ok := w.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package jsl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	plain := []byte("1\n2\n3\n")
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write(plain)
+	gzw.Close()
+
+	var zst bytes.Buffer
+	zw, _ := zstd.NewWriter(&zst)
+	zw.Write(plain)
+	zw.Close()
+
+	// bzip2 has no encoder in the standard library.
+	bz2 := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x12, 0x5d,
+		0x9f, 0x8a, 0x00, 0x00, 0x01, 0xc8, 0x00, 0x00, 0x10, 0x38, 0x00, 0x20,
+		0x00, 0x21, 0x9a, 0x68, 0x33, 0x4d, 0x1c, 0xb7, 0x8b, 0xb9, 0x22, 0x9c,
+		0x28, 0x48, 0x09, 0x2e, 0xcf, 0xc5, 0x00,
+	}
+
+	inputs := map[string][]byte{
+		"plain": plain,
+		"gzip":  gz.Bytes(),
+		"zstd":  zst.Bytes(),
+		"bzip2": bz2,
+	}
+
+	for name, input := range inputs {
+		r, err := Decompress(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("Decompress %s failed: %s", name, err)
+		}
+
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Read %s failed: %s", name, err)
+		}
+
+		if !bytes.Equal(data, plain) {
+			t.Errorf("Decompress %s = %q", name, data)
+		}
+	}
+
+	for _, short := range []string{"", "1", "BZh"} {
+		r, err := Decompress(bytes.NewReader([]byte(short)))
+		if err != nil {
+			t.Fatalf("Decompress %q failed: %s", short, err)
+		}
+
+		data, _ := io.ReadAll(r)
+		if string(data) != short {
+			t.Errorf("Decompress %q = %q", short, data)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	for _, method := range []string{"", "gzip", "zstd"} {
+		var output bytes.Buffer
+
+		// Two streams appended to the same output read back as one.
+		for _, part := range []string{"1\n", "2\n"} {
+			w, err := Compress(&output, method)
+			if err != nil {
+				t.Fatalf("Compress %s failed: %s", method, err)
+			}
+			w.Write([]byte(part))
+			w.Close()
+		}
+
+		if method != "" && bytes.HasPrefix(output.Bytes(), []byte("1\n")) {
+			t.Errorf("Compress %s output is not compressed.", method)
+		}
+
+		r, _ := Decompress(&output)
+		data, _ := io.ReadAll(r)
+		if string(data) != "1\n2\n" {
+			t.Errorf("Compress %s round trip = %q", method, data)
+		}
+	}
+
+	// A flushed stream reads back what was written before it is closed.
+	for _, method := range []string{"", "gzip", "zstd"} {
+		var output bytes.Buffer
+
+		w, _ := Compress(&output, method)
+		w.Write([]byte("1\n"))
+		if err := FlushCompressed(w); err != nil {
+			t.Fatalf("Flush %s failed: %s", method, err)
+		}
+
+		r, _ := Decompress(bytes.NewReader(output.Bytes()))
+		data, _ := io.ReadAll(r)
+		if string(data) != "1\n" {
+			t.Errorf("Flushed %s stream = %q", method, data)
+		}
+		w.Close()
+	}
+
+	if _, err := Compress(io.Discard, "lz4"); err == nil {
+		t.Errorf("Expected an error for an unknown compression.")
+	}
+
+	if CompressionFromFilename("out.jsonl.gz") != "gzip" || CompressionFromFilename("out.zst") != "zstd" || CompressionFromFilename("out.jsonl") != "" {
+		t.Errorf("Compression not inferred from the extension.")
+	}
+}
@@ -0,0 +1,522 @@
+package jsl
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduper records the dedupe keys seen so far, implementations are safe
+// to share between the iterators of parallel workers.
+type Deduper interface {
+	// Seen reports whether key has been seen before and records it.
+	Seen(key string) bool
+	Close() error
+}
+
+// seenAtDeduper is implemented by the in memory dedupers so keys loaded
+// from a store keep the time they were first seen.
+type seenAtDeduper interface {
+	Deduper
+	seenAt(key string, at time.Time) bool
+}
+
+// forgettingDeduper is implemented by the dedupers that forget keys, a
+// store is compacted to the keys they still remember.
+type forgettingDeduper interface {
+	seenAtDeduper
+
+	// eachKey calls fn with every key remembered, in the order they
+	// have to be loaded again.
+	eachKey(fn func(key string, at time.Time))
+}
+
+// DedupeConfig picks the dedupe backend. The zero value remembers every
+// key in memory.
+type DedupeConfig struct {
+	// MaxKeys keeps only the most recently seen keys, a key that was
+	// forgotten is emitted again.
+	MaxKeys int
+
+	// TTL forgets keys this long after they were first seen.
+	TTL time.Duration
+
+	// BloomKeys uses a Bloom filter sized for this many keys, which
+	// wrongly skips about FalsePositiveRate of the new keys.
+	BloomKeys         int
+	FalsePositiveRate float64
+
+	// Store is a file of keys kept across runs, keys in it are skipped
+	// and new keys are added to it. It needs MaxKeys, TTL or BloomKeys
+	// to bound the keys loaded into memory.
+	Store string
+}
+
+const DEFAULT_BLOOM_FALSE_POSITIVE_RATE = 0.001
+
+// Validate checks the settings of dc without opening the store.
+func (dc DedupeConfig) Validate() error {
+	if dc.MaxKeys < 0 || dc.TTL < 0 || dc.BloomKeys < 0 {
+		return errors.New("dedupe sizes must be positive")
+	}
+
+	if dc.BloomKeys > 0 {
+		if dc.MaxKeys > 0 || dc.TTL > 0 {
+			return errors.New("a bloom filter can't be combined with max keys or ttl")
+		}
+
+		if rate := dc.bloomRate(); rate <= 0 || rate >= 1 {
+			return fmt.Errorf("false positive rate %g is not between 0 and 1", rate)
+		}
+	}
+
+	if len(dc.Store) > 0 && dc.MaxKeys == 0 && dc.TTL == 0 && dc.BloomKeys == 0 {
+		return errors.New("a dedupe store needs max keys, a ttl or a bloom filter to bound the keys kept in memory")
+	}
+
+	return nil
+}
+
+func (dc DedupeConfig) bloomRate() float64 {
+	if dc.FalsePositiveRate == 0 {
+		return DEFAULT_BLOOM_FALSE_POSITIVE_RATE
+	}
+	return dc.FalsePositiveRate
+}
+
+// NewDeduper returns the backend described by dc.
+func NewDeduper(dc DedupeConfig) (Deduper, error) {
+	err := dc.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var deduper seenAtDeduper
+
+	switch {
+	case dc.BloomKeys > 0:
+		deduper = newBloomDeduper(dc.BloomKeys, dc.bloomRate())
+	case dc.TTL > 0:
+		deduper = newTTLDeduper(dc.TTL, dc.MaxKeys)
+	case dc.MaxKeys > 0:
+		deduper = newLRUDeduper(dc.MaxKeys)
+	default:
+		deduper = newDedupeSet()
+	}
+
+	if len(dc.Store) > 0 {
+		return openDedupeStore(dc.Store, deduper)
+	}
+	return deduper, nil
+}
+
+// dedupeSet remembers every key.
+type dedupeSet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newDedupeSet() *dedupeSet {
+	return &dedupeSet{
+		seen: make(map[string]bool, 0),
+	}
+}
+
+func (d *dedupeSet) Seen(key string) bool {
+	return d.seenAt(key, time.Time{})
+}
+
+func (d *dedupeSet) seenAt(key string, at time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, found := d.seen[key]; found {
+		return true
+	}
+
+	d.seen[key] = true
+	return false
+}
+
+func (d *dedupeSet) Close() error {
+	return nil
+}
+
+// lruDeduper remembers the max most recently seen keys.
+type lruDeduper struct {
+	mu     sync.Mutex
+	max    int
+	keys   map[string]*list.Element
+	recent *list.List
+}
+
+func newLRUDeduper(max int) *lruDeduper {
+	return &lruDeduper{
+		max:    max,
+		keys:   make(map[string]*list.Element),
+		recent: list.New(),
+	}
+}
+
+func (d *lruDeduper) Seen(key string) bool {
+	return d.seenAt(key, time.Time{})
+}
+
+func (d *lruDeduper) seenAt(key string, at time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if element, found := d.keys[key]; found {
+		d.recent.MoveToFront(element)
+		return true
+	}
+
+	d.keys[key] = d.recent.PushFront(&ttlEntry{key: key, at: at})
+
+	if d.recent.Len() > d.max {
+		oldest := d.recent.Back()
+		d.recent.Remove(oldest)
+		delete(d.keys, oldest.Value.(*ttlEntry).key)
+	}
+	return false
+}
+
+// eachKey gives the least recently seen key first.
+func (d *lruDeduper) eachKey(fn func(key string, at time.Time)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for element := d.recent.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*ttlEntry)
+		fn(entry.key, entry.at)
+	}
+}
+
+func (d *lruDeduper) Close() error {
+	return nil
+}
+
+type ttlEntry struct {
+	key string
+	at  time.Time
+}
+
+// ttlDeduper remembers keys for ttl after they were first seen, and at
+// most max keys when max is set.
+type ttlDeduper struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	max  int
+	keys map[string]*list.Element
+
+	// Entries in the order they were first seen, oldest first.
+	order *list.List
+	now   func() time.Time
+}
+
+func newTTLDeduper(ttl time.Duration, max int) *ttlDeduper {
+	return &ttlDeduper{
+		ttl:   ttl,
+		max:   max,
+		keys:  make(map[string]*list.Element),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+func (d *ttlDeduper) Seen(key string) bool {
+	return d.seenAt(key, d.now())
+}
+
+func (d *ttlDeduper) seenAt(key string, at time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(d.now())
+
+	if _, found := d.keys[key]; found {
+		return true
+	}
+
+	if at.Add(d.ttl).Before(d.now()) {
+		// Loaded from a store and already expired.
+		return false
+	}
+
+	// Keys from a store can be older than the newest key, they keep
+	// the order of expiry.
+	mark := d.order.Back()
+	for mark != nil && mark.Value.(*ttlEntry).at.After(at) {
+		mark = mark.Prev()
+	}
+
+	entry := &ttlEntry{key: key, at: at}
+	if mark == nil {
+		d.keys[key] = d.order.PushFront(entry)
+	} else {
+		d.keys[key] = d.order.InsertAfter(entry, mark)
+	}
+
+	if d.max > 0 && d.order.Len() > d.max {
+		d.remove(d.order.Front())
+	}
+	return false
+}
+
+func (d *ttlDeduper) expire(now time.Time) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		if front.Value.(*ttlEntry).at.Add(d.ttl).After(now) {
+			return
+		}
+		d.remove(front)
+	}
+}
+
+func (d *ttlDeduper) remove(element *list.Element) {
+	d.order.Remove(element)
+	delete(d.keys, element.Value.(*ttlEntry).key)
+}
+
+// eachKey gives the keys that did not expire, oldest first.
+func (d *ttlDeduper) eachKey(fn func(key string, at time.Time)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(d.now())
+	for element := d.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*ttlEntry)
+		fn(entry.key, entry.at)
+	}
+}
+
+func (d *ttlDeduper) Close() error {
+	return nil
+}
+
+// bloomDeduper is a Bloom filter, it never forgets a key and uses a
+// fixed amount of memory but wrongly reports some new keys as seen.
+type bloomDeduper struct {
+	mu     sync.Mutex
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// newBloomDeduper sizes the filter for keys keys with a false positive
+// rate of rate, m = -n ln(p) / ln(2)^2 bits and k = m/n ln(2) hashes.
+func newBloomDeduper(keys int, rate float64) *bloomDeduper {
+	size := uint64(math.Ceil(-float64(keys) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+
+	hashes := int(math.Round(float64(size) / float64(keys) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &bloomDeduper{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+func (d *bloomDeduper) Seen(key string) bool {
+	return d.seenAt(key, time.Time{})
+}
+
+func (d *bloomDeduper) seenAt(key string, at time.Time) bool {
+	h := sketchHash(key)
+	h1, h2 := h>>32, h&0xffffffff|1
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := true
+	for n := 0; n < d.hashes; n += 1 {
+		bit := (h1 + uint64(n)*h2) % d.size
+		if d.bits[bit/64]&(1<<(bit%64)) == 0 {
+			seen = false
+			d.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return seen
+}
+
+func (d *bloomDeduper) Close() error {
+	return nil
+}
+
+// dedupeStore keeps the keys of another deduper in a file so they are
+// skipped by later runs. Every line holds the time a key was first seen
+// in milliseconds and the key as a JSON string. New keys are appended,
+// when the deduper forgets keys the file is compacted to the keys it
+// still remembers as it is opened.
+type dedupeStore struct {
+	mu      sync.Mutex
+	deduper seenAtDeduper
+	file    *os.File
+	out     *bufio.Writer
+	err     error
+	now     func() time.Time
+}
+
+func openDedupeStore(filename string, deduper seenAtDeduper) (*dedupeStore, error) {
+	lines, err := loadDedupeStore(filename, deduper)
+	if err != nil {
+		return nil, err
+	}
+
+	if forgetting, ok := deduper.(forgettingDeduper); ok {
+		err = compactDedupeStore(filename, forgetting, lines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupeStore{
+		deduper: deduper,
+		file:    fh,
+		out:     bufio.NewWriter(fh),
+		now:     time.Now,
+	}, nil
+}
+
+// loadDedupeStore adds the keys of filename to deduper and returns the
+// number of lines read, a missing file has none.
+func loadDedupeStore(filename string, deduper seenAtDeduper) (int, error) {
+	fh, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+
+		var key string
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err == nil && len(fields) == 2 {
+			err = json.Unmarshal([]byte(fields[1]), &key)
+		} else if err == nil {
+			err = errors.New("missing key")
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+
+		deduper.seenAt(key, time.Unix(0, ms*int64(time.Millisecond)))
+	}
+
+	return line, scanner.Err()
+}
+
+// compactDedupeStore rewrites filename with the keys deduper remembers
+// when that drops some of its lines, duplicates and forgotten keys.
+func compactDedupeStore(filename string, deduper forgettingDeduper, lines int) error {
+	keys := 0
+	deduper.eachKey(func(key string, at time.Time) {
+		keys += 1
+	})
+	if keys >= lines {
+		return nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+
+	err = fh.Chmod(info.Mode())
+
+	out := bufio.NewWriter(fh)
+	deduper.eachKey(func(key string, at time.Time) {
+		if err == nil {
+			err = writeDedupeKey(out, key, at)
+		}
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fh.Name(), filename)
+}
+
+func writeDedupeKey(w io.Writer, key string, at time.Time) error {
+	encoded, _ := json.Marshal(key)
+	_, err := fmt.Fprintf(w, "%d %s\n", at.UnixNano()/int64(time.Millisecond), encoded)
+	return err
+}
+
+func (d *dedupeStore) Seen(key string) bool {
+	now := d.now()
+	if d.deduper.seenAt(key, now) {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := writeDedupeKey(d.out, key, now)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return false
+}
+
+// Close writes out the new keys, it returns the first error writing
+// them.
+func (d *dedupeStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.out.Flush(); err != nil && d.err == nil {
+		d.err = err
+	}
+	if err := d.file.Sync(); err != nil && d.err == nil {
+		d.err = err
+	}
+	if err := d.file.Close(); err != nil && d.err == nil {
+		d.err = err
+	}
+	return d.err
+}
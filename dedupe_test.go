@@ -0,0 +1,164 @@
+package jsl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func seenKeys(d Deduper, keys string) string {
+	var result []string
+	for _, key := range strings.Split(keys, " ") {
+		if d.Seen(key) {
+			result = append(result, key)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+func TestDeduper_LRU(t *testing.T) {
+	d, _ := NewDeduper(DedupeConfig{MaxKeys: 2})
+
+	// c pushes out b, a was seen again so it stays.
+	if seen := seenKeys(d, "a b a c a b"); seen != "a a" {
+		t.Errorf("Seen %q", seen)
+	}
+}
+
+func TestDeduper_TTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newTTLDeduper(time.Minute, 0)
+	d.now = func() time.Time { return now }
+
+	if seen := seenKeys(d, "a b a"); seen != "a" {
+		t.Errorf("Seen %q", seen)
+	}
+
+	now = now.Add(30 * time.Second)
+	if seen := seenKeys(d, "c a"); seen != "a" {
+		t.Errorf("Seen %q", seen)
+	}
+
+	// a and b expire, c was first seen 30s later.
+	now = now.Add(31 * time.Second)
+	if seen := seenKeys(d, "a c b"); seen != "c" {
+		t.Errorf("Seen %q", seen)
+	}
+
+	capped := newTTLDeduper(time.Minute, 2)
+	if seen := seenKeys(capped, "a b c a"); seen != "" {
+		t.Errorf("Seen %q", seen)
+	}
+}
+
+func TestDeduper_Bloom(t *testing.T) {
+	d, err := NewDeduper(DedupeConfig{BloomKeys: 10000, FalsePositiveRate: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 10000; n += 1 {
+		d.Seen(fmt.Sprintf("key-%d", n))
+	}
+
+	for n := 0; n < 10000; n += 1 {
+		if !d.Seen(fmt.Sprintf("key-%d", n)) {
+			t.Fatalf("key-%d was forgotten", n)
+		}
+	}
+
+	// Seen adds the new keys too, so only a few are checked.
+	var wrong int
+	for n := 0; n < 1000; n += 1 {
+		if d.Seen(fmt.Sprintf("other-%d", n)) {
+			wrong += 1
+		}
+	}
+
+	if wrong > 30 {
+		t.Errorf("%d of 1000 new keys seen, expected about 10", wrong)
+	}
+
+	if _, err := NewDeduper(DedupeConfig{BloomKeys: 10, TTL: time.Second}); err == nil {
+		t.Errorf("Expected an error combining bloom and ttl.")
+	}
+}
+
+func TestDeduper_Store(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "seen.keys")
+
+	if _, err := NewDeduper(DedupeConfig{Store: store}); err == nil {
+		t.Errorf("Expected an error for a store without a bound.")
+	}
+
+	d, err := NewDeduper(DedupeConfig{Store: store, MaxKeys: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen := seenKeys(d, "a b\nc a"); seen != "a" {
+		t.Errorf("Seen %q", seen)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run skips the keys of the first.
+	d, _ = NewDeduper(DedupeConfig{Store: store, MaxKeys: 100})
+	if seen := seenKeys(d, "b\nc d a"); seen != "b\nc a" {
+		t.Errorf("Seen %q", seen)
+	}
+	d.Close()
+
+	data, _ := ioutil.ReadFile(store)
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("Expected 3 keys in the store, got %q", data)
+	}
+
+	// Keys older than the ttl are not loaded.
+	ioutil.WriteFile(store, []byte(fmt.Sprintf("1000 \"old\"\n%d \"new\"\n", time.Now().UnixNano()/int64(time.Millisecond))), 0644)
+	d, _ = NewDeduper(DedupeConfig{Store: store, TTL: time.Hour})
+	if seen := seenKeys(d, "old new"); seen != "new" {
+		t.Errorf("Seen %q", seen)
+	}
+	d.Close()
+
+	ioutil.WriteFile(store, []byte("not a key\n"), 0644)
+	if _, err := NewDeduper(DedupeConfig{Store: store, MaxKeys: 100}); err == nil {
+		t.Errorf("Expected an error for a broken store.")
+	}
+}
+
+func TestDeduper_StoreCompact(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "seen.keys")
+
+	// a and b are pushed out and appended again when they come back.
+	d, _ := NewDeduper(DedupeConfig{Store: store, MaxKeys: 2})
+	if seen := seenKeys(d, "a b c a b"); seen != "" {
+		t.Errorf("Seen %q", seen)
+	}
+	d.Close()
+
+	data, _ := ioutil.ReadFile(store)
+	if lines := strings.Count(string(data), "\n"); lines != 5 {
+		t.Errorf("Expected 5 keys appended, got %q", data)
+	}
+
+	// Opening the store drops the keys forgotten while loading it.
+	d, _ = NewDeduper(DedupeConfig{Store: store, MaxKeys: 2})
+	d.Close()
+
+	data, _ = ioutil.ReadFile(store)
+	if keys := strings.Count(string(data), "\n"); keys != 2 || !strings.Contains(string(data), `"a"`) || !strings.Contains(string(data), `"b"`) {
+		t.Errorf("Expected a and b in the compacted store, got %q", data)
+	}
+
+	d, _ = NewDeduper(DedupeConfig{Store: store, MaxKeys: 2})
+	if seen := seenKeys(d, "b a"); seen != "b a" {
+		t.Errorf("Seen %q", seen)
+	}
+	d.Close()
+}
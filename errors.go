@@ -0,0 +1,191 @@
+package jsl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/parser"
+)
+
+// StageError is an error raised by one of the javascript stages, with the
+// row it was raised for and where that row was read from.
+type StageError struct {
+	// Stage is pre, filter, dedupe, iter, group, accum, window, merge,
+	// post, or partition and output for results that can't be written.
+	Stage string
+
+	// File and Line locate the row, they are empty for errors that are
+	// not raised for a row (pre, merge and post) or when the row was not
+	// read from a file.
+	File   string
+	Line   int
+	Record interface{}
+
+	// Stack is the javascript stack trace of exceptions.
+	Stack string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	location := ""
+	if len(e.File) > 0 {
+		location = fmt.Sprintf("%s:%d: ", e.File, e.Line)
+	} else if e.Line > 0 {
+		location = fmt.Sprintf("line %d: ", e.Line)
+	}
+
+	return fmt.Sprintf("%s%s: %s", location, e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON encodes the error as it is written by ErrorWriter.
+func (e *StageError) MarshalJSON() ([]byte, error) {
+	var file interface{}
+	if len(e.File) > 0 {
+		file = e.File
+	}
+
+	var line interface{}
+	if e.Line > 0 {
+		line = e.Line
+	}
+
+	message := e.Err.Error()
+	if exception, ok := e.Err.(*goja.Exception); ok && exception.Value() != nil {
+		message = exception.Value().String()
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"stage":  e.Stage,
+		"file":   file,
+		"line":   line,
+		"error":  message,
+		"stack":  e.Stack,
+		"record": e.Record,
+	})
+}
+
+// atStage wraps err as a StageError raised by stage, errors that are
+// already wrapped keep their stage.
+func atStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*StageError); ok {
+		return err
+	}
+
+	stageErr := &StageError{Stage: stage, Err: err}
+	if exception, ok := err.(*goja.Exception); ok {
+		stageErr.Stack = strings.TrimSpace(exception.String())
+	}
+	return stageErr
+}
+
+// ScriptError is javascript given for a stage that does not compile.
+// Line and Column are the position of the error in Code, counted from 1,
+// and are 0 when it is not known.
+type ScriptError struct {
+	Stage   string
+	Code    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ScriptError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: SyntaxError: %s", e.Stage, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Stage, e.Message)
+}
+
+// Pointer returns the line of code with the error and a caret under the
+// column of the error.
+func (e *ScriptError) Pointer() string {
+	lines := strings.Split(e.Code, "\n")
+	if e.Line < 1 || e.Line > len(lines) {
+		return ""
+	}
+
+	line := lines[e.Line-1]
+	indent := []rune{}
+	for n, c := range []rune(line) {
+		if n >= e.Column-1 {
+			break
+		}
+		if c != '\t' {
+			c = ' '
+		}
+		indent = append(indent, c)
+	}
+
+	return fmt.Sprintf("  %s\n  %s^\n", line, string(indent))
+}
+
+// newScriptError places the parser error err of prefix + code + suffix
+// in code. The parser counts columns in bytes, they are turned into
+// characters.
+func newScriptError(stage string, prefix string, code string, err *parser.Error) *ScriptError {
+	line, column := err.Position.Line, err.Position.Column
+
+	prefixLines := strings.Split(prefix, "\n")
+	line -= len(prefixLines) - 1
+	if line == 1 {
+		column -= len(prefixLines[len(prefixLines)-1])
+	}
+
+	// Errors found in the wrapping past the code, like a missing closing
+	// bracket, point just past the end of the code.
+	codeLines := strings.Split(code, "\n")
+	if line > len(codeLines) || line == len(codeLines) && column > len(codeLines[line-1]) {
+		line = len(codeLines)
+		column = len(codeLines[line-1]) + 1
+	}
+
+	if line < 1 || column < 1 {
+		line, column = 1, 1
+	}
+	column = utf8.RuneCountInString(codeLines[line-1][:column-1]) + 1
+
+	return &ScriptError{
+		Stage:   stage,
+		Code:    code,
+		Line:    line,
+		Column:  column,
+		Message: err.Message,
+	}
+}
+
+// ErrorWriter writes errors as lines of JSON, StageErrors with their
+// stage, file, line, error, stack and record. The failed records can be
+// processed again from it once the script is fixed. It is safe to use
+// from parallel workers.
+type ErrorWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewErrorWriter(w io.Writer) *ErrorWriter {
+	return &ErrorWriter{enc: json.NewEncoder(w)}
+}
+
+func (e *ErrorWriter) Write(err error) error {
+	var value interface{} = err
+	if _, ok := err.(*StageError); !ok {
+		value = map[string]interface{}{"error": err.Error()}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(value)
+}
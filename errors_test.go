@@ -0,0 +1,149 @@
+package jsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIterator_StageErrors(t *testing.T) {
+	cases := map[string]IterConfig{
+		"filter": {Filter: "i.a.b"},
+		"dedupe": {Dedupe: "i.a.b"},
+		"iter":   {Iter: "i.a.b"},
+		"group":  {Group: "i.a.b", Accumulator: "accum"},
+		"accum":  {Accumulator: "i.a.b"},
+	}
+
+	for stage, ic := range cases {
+		ic.Emitter = func(i interface{}) {}
+		iter, err := NewIterator(&ic)
+		if err != nil {
+			t.Fatalf("Failed to create iterator: %s", err)
+		}
+
+		iter.PreIteration()
+		row, _ := LoadLine(`{"n": 1}`)
+		err = iter.IterRecord(Record{File: "in.json", Line: 3, Value: row})
+
+		var stageErr *StageError
+		if !errors.As(err, &stageErr) {
+			t.Errorf("%s: expected a StageError, got %v", stage, err)
+			continue
+		}
+
+		if stageErr.Stage != stage || stageErr.File != "in.json" || stageErr.Line != 3 {
+			t.Errorf("%s: wrong context %s", stage, stageErr)
+		}
+
+		if !strings.HasPrefix(stageErr.Error(), "in.json:3: "+stage+": TypeError") {
+			t.Errorf("%s: wrong message %q", stage, stageErr.Error())
+		}
+
+		if !strings.Contains(stageErr.Stack, "at ") {
+			t.Errorf("%s: missing stack %q", stage, stageErr.Stack)
+		}
+
+		if stageErr.Record.(map[string]interface{})["n"] != float64(1) {
+			t.Errorf("%s: wrong record %v", stage, stageErr.Record)
+		}
+	}
+}
+
+func TestHandleParallel_OnError(t *testing.T) {
+	var output bytes.Buffer
+	errorWriter := NewErrorWriter(&output)
+
+	input := make(chan Record)
+	go func() {
+		for n, line := range []string{`{"a": {"b": 1}}`, `{"c": 2}`, `{"a": {"b": 3}}`} {
+			row, _ := LoadLine(line)
+			input <- Record{Seq: uint64(n), File: "in.json", Line: n + 1, Value: row}
+		}
+		close(input)
+	}()
+
+	var results []interface{}
+	err := HandleParallel(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i)
+		},
+		Iter: "i.a.b",
+	}, ParallelConfig{Workers: 1, OnError: func(err error) { errorWriter.Write(err) }}, input)
+
+	if err != nil {
+		t.Fatalf("Parallel iteration failed: %s", err)
+	}
+
+	if len(results) != 2 {
+		t.Errorf("Expected 2 results, got %v", results)
+	}
+
+	var written map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &written); err != nil {
+		t.Fatalf("Error output is not one json line: %q", output.String())
+	}
+
+	if written["stage"] != "iter" || written["file"] != "in.json" || written["line"] != float64(2) {
+		t.Errorf("Wrong error context: %v", written)
+	}
+
+	if !strings.HasPrefix(written["error"].(string), "TypeError") || len(written["stack"].(string)) == 0 {
+		t.Errorf("Wrong error or stack: %v", written)
+	}
+
+	if record, ok := written["record"].(map[string]interface{}); !ok || record["c"] != float64(2) {
+		t.Errorf("Wrong record: %v", written["record"])
+	}
+}
+
+func TestNewIterator_ScriptErrors(t *testing.T) {
+	cases := []struct {
+		ic     IterConfig
+		stage  string
+		line   int
+		column int
+	}{
+		{IterConfig{Iter: "i.a.b)"}, "iter", 1, 6},
+		{IterConfig{Filter: "i.a ==== 1"}, "filter", 1, 8},
+		{IterConfig{Accumulator: "accum.n += 1;\naccum.m += )"}, "accum", 2, 12},
+		{IterConfig{Iter: "(i.a"}, "iter", 1, 5},
+		{IterConfig{Pre: "{n: }"}, "pre", 1, 5},
+		{IterConfig{Group: "i.k +"}, "group", 1, 6},
+		{IterConfig{Window: WindowConfig{Time: time.Second, Timestamp: "i.ts +"}}, "window", 1, 7},
+		{IterConfig{Iter: "'éé' + )"}, "iter", 1, 8},
+		{IterConfig{Iter: "'é'\n + ('ü' ]"}, "iter", 2, 9},
+		{IterConfig{Filter: "i }; function filter(i) { return 42"}, "filter", 1, 3},
+		{IterConfig{Accumulator: "accum.n = 1 } function accumulator(i, accum) { accum.n = 2"}, "accum", 1, 13},
+	}
+
+	for _, c := range cases {
+		_, err := NewIterator(&c.ic)
+
+		scriptErr, ok := err.(*ScriptError)
+		if !ok {
+			t.Errorf("%s: expected a ScriptError, got %v", c.stage, err)
+			continue
+		}
+
+		if scriptErr.Stage != c.stage || scriptErr.Line != c.line || scriptErr.Column != c.column {
+			t.Errorf("%s: wrong position %s, expected %d:%d", c.stage, scriptErr, c.line, c.column)
+		}
+	}
+
+	_, err := NewIterator(&IterConfig{Iter: "i.a.b)"})
+	if err == nil || err.Error() != "iter:1:6: SyntaxError: Unexpected token )" {
+		t.Errorf("Wrong message: %v", err)
+	}
+
+	if pointer := err.(*ScriptError).Pointer(); pointer != "  i.a.b)\n       ^\n" {
+		t.Errorf("Wrong pointer:\n%s", pointer)
+	}
+
+	if _, err := NewIterator(&IterConfig{Iter: "i.a", Filter: "i.b > 1", Accumulator: "accum.n += 1"}); err != nil {
+		t.Errorf("Valid scripts failed: %s", err)
+	}
+}
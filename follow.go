@@ -0,0 +1,170 @@
+package jsl
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+const DEFAULT_FOLLOW_POLL = 250 * time.Millisecond
+
+// FollowOptions makes ReadFiles keep reading the last input file as it
+// grows, like tail -F, until Stop is closed.
+type FollowOptions struct {
+	Follow bool
+
+	// Poll is how long to wait for new data after reaching the end of
+	// the file.
+	Poll time.Duration
+
+	// Stop ends following, the lines read so far are still handled.
+	Stop chan bool
+}
+
+// followTail is how many of the last bytes read are kept to tell a file
+// that was appended to from one that was written again.
+const followTail = 64
+
+// followReader reads a file that is being appended to. At the end of the
+// file it waits for more data instead of returning io.EOF. A file that
+// shrinks or no longer has the bytes last read before the offset was
+// truncated and is read again from the start, a file that was replaced
+// (moved away and created again) is reopened once the old one has been
+// read to the end.
+type followReader struct {
+	filename string
+	file     *os.File
+	offset   int64
+	opts     FollowOptions
+
+	// tail is the end of what was read and modTime the modification
+	// time of the file when its end was reached.
+	tail    []byte
+	modTime time.Time
+}
+
+func newFollowReader(filename string, opts FollowOptions) (*followReader, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Poll <= 0 {
+		opts.Poll = DEFAULT_FOLLOW_POLL
+	}
+
+	return &followReader{filename: filename, file: fh, opts: opts}, nil
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+
+		if n > 0 {
+			f.tail = append(f.tail, p[:n]...)
+			if len(f.tail) > followTail {
+				f.tail = append(f.tail[:0], f.tail[len(f.tail)-followTail:]...)
+			}
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if info, err := f.file.Stat(); err == nil {
+			f.modTime = info.ModTime()
+		}
+
+		// Checked before waiting, so a replaced file is switched to
+		// right away, and after, so data written while waiting is not
+		// read from the middle of a file that was written again.
+		for waited := false; ; waited = true {
+			select {
+			case <-f.opts.Stop:
+				return 0, io.EOF
+			default:
+			}
+
+			switched, err := f.checkFile()
+			if err != nil {
+				return 0, err
+			}
+			if switched || waited {
+				break
+			}
+
+			select {
+			case <-f.opts.Stop:
+				return 0, io.EOF
+			case <-time.After(f.opts.Poll):
+			}
+		}
+	}
+}
+
+// checkFile handles truncation and rotation, it returns true when
+// reading should start again right away.
+func (f *followReader) checkFile() (bool, error) {
+	current, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if current.Size() < f.offset || f.rewritten(current) {
+		_, err := f.file.Seek(0, io.SeekStart)
+		f.offset = 0
+		f.tail = f.tail[:0]
+		return err == nil, err
+	}
+
+	latest, err := os.Stat(f.filename)
+	if err != nil {
+		// Moved away and not created again yet.
+		return false, nil
+	}
+
+	if os.SameFile(current, latest) {
+		return false, nil
+	}
+
+	// Lines written to the old file after the last read come first.
+	if current.Size() > f.offset {
+		return true, nil
+	}
+
+	fh, err := os.Open(f.filename)
+	if err != nil {
+		return false, nil
+	}
+
+	f.file.Close()
+	f.file = fh
+	f.offset = 0
+	f.tail = f.tail[:0]
+	return true, nil
+}
+
+// rewritten reports whether the file was truncated and written again past
+// the offset since its end was reached, a file that changed no longer has
+// the bytes last read just before the offset.
+func (f *followReader) rewritten(current os.FileInfo) bool {
+	if current.Size() == f.offset && current.ModTime().Equal(f.modTime) {
+		return false
+	}
+
+	if len(f.tail) == 0 {
+		return false
+	}
+
+	tail := make([]byte, len(f.tail))
+	if _, err := f.file.ReadAt(tail, f.offset-int64(len(f.tail))); err != nil {
+		return false
+	}
+	return !bytes.Equal(tail, f.tail)
+}
+
+func (f *followReader) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,79 @@
+package jsl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollowFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+
+	os.WriteFile(filename, []byte("1\n"), 0644)
+
+	reader, _ := NewReader("json", ReadOptions{})
+	objs := make(chan Record, 10)
+	follow := FollowOptions{Follow: true, Poll: 5 * time.Millisecond, Stop: make(chan bool)}
+
+	read_done := make(chan error, 1)
+	go func() {
+		read_done <- FollowFiles(reader, []string{filename}, objs, follow)
+	}()
+
+	expect := func(expected interface{}) {
+		select {
+		case rec := <-objs:
+			if rec.Value != expected {
+				t.Fatalf("Read %#v, expected %#v", rec.Value, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %#v", expected)
+		}
+	}
+
+	appendLine := func(name string, line string) {
+		fh, _ := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		fh.WriteString(line)
+		fh.Close()
+	}
+
+	expect(int64(1))
+
+	// A line written in two parts is read once it is complete.
+	appendLine(filename, "2")
+	time.Sleep(20 * time.Millisecond)
+	appendLine(filename, "3\n")
+	expect(int64(23))
+
+	// Truncated and written again.
+	os.WriteFile(filename, []byte("4\n"), 0644)
+	expect(int64(4))
+
+	// Truncated and written again past where reading was.
+	os.WriteFile(filename, []byte("77777\n"), 0644)
+	expect(int64(77777))
+
+	// Rotated, with a last line in the old file.
+	os.Rename(filename, filename+".1")
+	appendLine(filename+".1", "5\n")
+	appendLine(filename, "6\n")
+	expect(int64(5))
+	expect(int64(6))
+
+	close(follow.Stop)
+
+	select {
+	case err := <-read_done:
+		if err != nil {
+			t.Errorf("Follow failed: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Follow did not stop.")
+	}
+
+	if _, open := <-objs; open {
+		t.Errorf("Expected objs to be closed.")
+	}
+}
@@ -0,0 +1,215 @@
+package jsl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// RecordReader decodes a stream of input into records, each record is
+// sent to objs with its Line set. Implementations close objs when they
+// return.
+type RecordReader interface {
+	ReadRecords(objs chan Record, r io.Reader) error
+}
+
+// RecordWriter encodes the values emitted by an iterator. Values are
+// plain go values, see ExportValue, goja values are only accepted from
+// the goroutine running their VM.
+type RecordWriter interface {
+	WriteRecord(v interface{}) error
+	Flush() error
+}
+
+// WriteOptions controls how the writers encode their output.
+type WriteOptions struct {
+	// Columns of csv and tsv output, see CSVWriter.
+	Columns []string
+
+	// NoHeader leaves out the header row of csv and tsv output, for
+	// appending to a file that already has one, see AppendOptions.
+	NoHeader bool
+}
+
+// ReaderFunc adapts a reader function such as ReadJsonObjectsWithOptions
+// or CSV_ReadObjectsUntilEOF to a RecordReader.
+type ReaderFunc func(objs chan Record, r io.Reader, opts ReadOptions) error
+
+type funcReader struct {
+	read ReaderFunc
+	opts ReadOptions
+}
+
+func (f funcReader) ReadRecords(objs chan Record, r io.Reader) error {
+	return f.read(objs, r, f.opts)
+}
+
+// NewReaderFunc returns a RecordReader that calls read with opts.
+func NewReaderFunc(read ReaderFunc, opts ReadOptions) RecordReader {
+	return funcReader{read: read, opts: opts}
+}
+
+var formatLock sync.Mutex
+var readerFormats = map[string]func(ReadOptions) RecordReader{}
+var writerFormats = map[string]func(io.Writer, WriteOptions) RecordWriter{}
+
+// RegisterReader makes a reader available under the format name, an
+// existing format with the same name is replaced.
+func RegisterReader(name string, factory func(ReadOptions) RecordReader) {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+	readerFormats[name] = factory
+}
+
+// RegisterWriter makes a writer available under the format name, an
+// existing format with the same name is replaced.
+func RegisterWriter(name string, factory func(io.Writer, WriteOptions) RecordWriter) {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+	writerFormats[name] = factory
+}
+
+// NewReader returns the reader registered for the format name.
+func NewReader(name string, opts ReadOptions) (RecordReader, error) {
+	formatLock.Lock()
+	factory, found := readerFormats[name]
+	formatLock.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("unknown input format %s", name)
+	}
+	return factory(opts), nil
+}
+
+// NewWriter returns the writer registered for the format name.
+func NewWriter(name string, w io.Writer, opts WriteOptions) (RecordWriter, error) {
+	formatLock.Lock()
+	factory, found := writerFormats[name]
+	formatLock.Unlock()
+
+	if !found {
+		return nil, fmt.Errorf("unknown output format %s", name)
+	}
+	return factory(w, opts), nil
+}
+
+// ReaderFormats lists the registered input formats.
+func ReaderFormats() []string {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+
+	names := make([]string, 0, len(readerFormats))
+	for name := range readerFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriterFormats lists the registered output formats.
+func WriterFormats() []string {
+	formatLock.Lock()
+	defer formatLock.Unlock()
+
+	names := make([]string, 0, len(writerFormats))
+	for name := range writerFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterReader("json", func(opts ReadOptions) RecordReader {
+		return NewReaderFunc(ReadJsonObjectsWithOptions, opts)
+	})
+	RegisterReader("nested", func(opts ReadOptions) RecordReader {
+		return NewReaderFunc(Nested_ReadJsonObjectsWithOptions, opts)
+	})
+	RegisterReader("flatten", func(opts ReadOptions) RecordReader {
+		return NewReaderFunc(Flatten_ReadJsonObjectsWithOptions, opts)
+	})
+	RegisterReader("csv", func(opts ReadOptions) RecordReader {
+		if opts.Delimiter == 0 {
+			opts.Delimiter = ','
+		}
+		return NewReaderFunc(CSV_ReadObjectsUntilEOF, opts)
+	})
+	RegisterReader("tsv", func(opts ReadOptions) RecordReader {
+		if opts.Delimiter == 0 {
+			opts.Delimiter = '\t'
+		}
+		return NewReaderFunc(CSV_ReadObjectsUntilEOF, opts)
+	})
+
+	RegisterWriter("json", func(w io.Writer, opts WriteOptions) RecordWriter {
+		return NewJSONWriter(w)
+	})
+	RegisterWriter("text", func(w io.Writer, opts WriteOptions) RecordWriter {
+		return NewTextWriter(w)
+	})
+	RegisterWriter("csv", func(w io.Writer, opts WriteOptions) RecordWriter {
+		writer := NewCSVWriter(w, ',', opts.Columns)
+		writer.hasHeader = opts.NoHeader
+		return writer
+	})
+	RegisterWriter("tsv", func(w io.Writer, opts WriteOptions) RecordWriter {
+		writer := NewCSVWriter(w, '\t', opts.Columns)
+		writer.hasHeader = opts.NoHeader
+		return writer
+	})
+}
+
+// ExportValue returns the go value of goja values. A goja.Runtime is not
+// safe to share between goroutines, so values are exported on the
+// goroutine running their VM before they are handed to another one.
+// Aggregates are replaced by their value, the accumulator keeps adding
+// to them after they are emitted.
+func ExportValue(v interface{}) interface{} {
+	if value, ok := v.(goja.Value); ok {
+		v = value.Export()
+	}
+
+	snapshot, _ := snapshotAggregates(v)
+	return snapshot
+}
+
+// JSONWriter writes every value as a line of JSON.
+type JSONWriter struct {
+	enc *json.Encoder
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (j *JSONWriter) WriteRecord(v interface{}) error {
+	return j.enc.Encode(ExportValue(v))
+}
+
+func (j *JSONWriter) Flush() error {
+	return nil
+}
+
+// TextWriter writes every value as a line of text, javascript values are
+// converted with their toString.
+type TextWriter struct {
+	w io.Writer
+}
+
+func NewTextWriter(w io.Writer) *TextWriter {
+	return &TextWriter{w: w}
+}
+
+func (t *TextWriter) WriteRecord(v interface{}) error {
+	_, err := fmt.Fprintln(t.w, v)
+	return err
+}
+
+func (t *TextWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package jsl
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+type upperReader struct{}
+
+func (upperReader) ReadRecords(objs chan Record, r io.Reader) error {
+	defer close(objs)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	for _, word := range strings.Fields(string(data)) {
+		objs <- Record{Value: strings.ToUpper(word)}
+	}
+	return nil
+}
+
+func TestFormatRegistry(t *testing.T) {
+	RegisterReader("words", func(opts ReadOptions) RecordReader {
+		return upperReader{}
+	})
+
+	reader, err := NewReader("words", ReadOptions{})
+	if err != nil {
+		t.Fatalf("Registered reader not found: %s", err)
+	}
+
+	var output bytes.Buffer
+	writer, err := NewWriter("json", &output, WriteOptions{})
+	if err != nil {
+		t.Fatalf("Builtin writer not found: %s", err)
+	}
+
+	objs := make(chan Record, 10)
+	if err := reader.ReadRecords(objs, strings.NewReader("a b\nc")); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	iter, _ := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			writer.WriteRecord(i)
+		},
+		Iter: "i + '!'",
+	})
+	iter.PreIteration()
+	for rec := range objs {
+		iter.IterRecord(rec)
+	}
+	writer.Flush()
+
+	if output.String() != "\"A!\"\n\"B!\"\n\"C!\"\n" {
+		t.Errorf("Incorrect output: %q", output.String())
+	}
+
+	if _, err := NewReader("missing", ReadOptions{}); err == nil {
+		t.Errorf("Expected an error for an unknown format.")
+	}
+
+	for _, name := range []string{"json", "nested", "flatten", "csv", "tsv"} {
+		if _, err := NewReader(name, ReadOptions{}); err != nil {
+			t.Errorf("Builtin reader %s not found.", name)
+		}
+	}
+
+	for _, name := range []string{"json", "text", "csv", "tsv"} {
+		if _, err := NewWriter(name, &output, WriteOptions{}); err != nil {
+			t.Errorf("Builtin writer %s not found.", name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package jsl
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// CSV_ReadObjectsUntilEOF reads delimited rows, each row is sent as an
+// object keyed by the names in the header row. Fields beyond the header
+// are keyed by their column number.
+//
+// Tab delimited input is read as TSV, where fields are never quoted.
+func CSV_ReadObjectsUntilEOF(objs chan Record, r io.Reader, opts ReadOptions) error {
+	defer close(objs)
+
+	// A byte order mark would end up in the first name of the header, or
+	// make a quoted one fail to parse.
+	buffered := bufio.NewReader(r)
+	if bom, _ := buffered.Peek(3); string(bom) == "\ufeff" {
+		buffered.Discard(3)
+	}
+	r = buffered
+
+	// read returns the next row and the line it starts on.
+	var read func() ([]string, int, error)
+
+	if opts.Delimiter == '\t' {
+		read = tsvReader(r)
+	} else {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+		if opts.Delimiter != 0 {
+			reader.Comma = opts.Delimiter
+		}
+
+		read = func() ([]string, int, error) {
+			record, err := reader.Read()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			line, _ := reader.FieldPos(0)
+			return record, line, nil
+		}
+	}
+
+	var header []string
+
+	for {
+		record, line, err := read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			log.Printf("csv_decode_err: %s", err)
+			opts.Stats.Add(ParseError)
+			if opts.FailOnException {
+				return err
+			}
+			continue
+		}
+
+		if header == nil && !opts.NoHeader {
+			header = append([]string{}, record...)
+			continue
+		}
+
+		if opts.NoHeader {
+			row := make([]interface{}, len(record))
+			for n, field := range record {
+				row[n] = csvValue(field, opts)
+			}
+			objs <- Record{Line: line, Value: row}
+			continue
+		}
+
+		row := make(map[string]interface{}, len(record))
+		for n, field := range record {
+			if n < len(header) {
+				row[header[n]] = csvValue(field, opts)
+			} else {
+				row[strconv.Itoa(n)] = csvValue(field, opts)
+			}
+		}
+		objs <- Record{Line: line, Value: row}
+	}
+}
+
+// tsvReader splits lines on tabs, a trailing \r is dropped and empty
+// lines are skipped.
+func tsvReader(r io.Reader) func() ([]string, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	lineNumber := 0
+
+	return func() ([]string, int, error) {
+		for scanner.Scan() {
+			lineNumber += 1
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if len(line) > 0 {
+				return strings.Split(line, "\t"), lineNumber, nil
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, io.EOF
+	}
+}
+
+// csvValue converts a field to a number or boolean when InferTypes is
+// set and the whole field is one, otherwise the field stays a string.
+func csvValue(field string, opts ReadOptions) interface{} {
+	if !opts.InferTypes || len(field) == 0 {
+		return field
+	}
+
+	switch c := field[0]; {
+	case field == "true":
+		return true
+	case field == "false":
+		return false
+	case c == '-' || isDigit(c):
+		if value, err := loadNumber(field, opts); err == nil {
+			return value
+		}
+	}
+
+	return field
+}
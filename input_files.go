@@ -0,0 +1,126 @@
+package jsl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// STDIN_FILENAME reads standard input when used as an input filename.
+const STDIN_FILENAME = "-"
+
+// ExpandInputs expands the glob patterns in inputs, in order. A pattern
+// that matches nothing is an error, names without glob characters are
+// kept as they are.
+func ExpandInputs(inputs []string) ([]string, error) {
+	var filenames []string
+
+	for _, input := range inputs {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			if input == STDIN_FILENAME || !hasGlobMeta(input) {
+				filenames = append(filenames, input)
+				continue
+			}
+			return nil, fmt.Errorf("no input files match %s", input)
+		}
+
+		filenames = append(filenames, matches...)
+	}
+
+	return filenames, nil
+}
+
+func hasGlobMeta(path string) bool {
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFiles reads each file in turn with reader, decompressing it when
+// needed, and sends the records to objs with File set. An empty list of
+// filenames reads stdin. objs is closed once every file has been read.
+func ReadFiles(reader RecordReader, filenames []string, objs chan Record) error {
+	return FollowFiles(reader, filenames, objs, FollowOptions{})
+}
+
+// FollowFiles is ReadFiles, but with follow.Follow set the last file is
+// followed as it grows instead of ending at its end, until follow.Stop
+// is closed. Followed files are not decompressed and stdin is never
+// followed.
+func FollowFiles(reader RecordReader, filenames []string, objs chan Record, follow FollowOptions) error {
+	defer close(objs)
+
+	if len(filenames) == 0 {
+		filenames = []string{STDIN_FILENAME}
+	}
+
+	for n, filename := range filenames {
+		file_follow := follow
+		file_follow.Follow = follow.Follow && n == len(filenames)-1 && filename != STDIN_FILENAME
+
+		err := readFile(reader, filename, objs, file_follow)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readFile(reader RecordReader, filename string, objs chan Record, follow FollowOptions) error {
+	var input io.ReadCloser
+
+	if follow.Follow {
+		followed, err := newFollowReader(filename, follow)
+		if err != nil {
+			return err
+		}
+		defer followed.Close()
+		input = followed
+	} else {
+		var raw io.Reader = os.Stdin
+
+		if filename != STDIN_FILENAME {
+			fh, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			raw = fh
+		}
+
+		decompressed, err := Decompress(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		defer decompressed.Close()
+		input = decompressed
+	}
+
+	file_objs := make(chan Record)
+	read_done := make(chan error, 1)
+	go func() {
+		read_done <- reader.ReadRecords(file_objs, input)
+	}()
+
+	for rec := range file_objs {
+		rec.File = filename
+		objs <- rec
+	}
+
+	err := <-read_done
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
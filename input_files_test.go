@@ -0,0 +1,61 @@
+package jsl
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "a.log"), []byte("1\n\n2\n"), 0644)
+
+	fh, _ := os.Create(filepath.Join(dir, "b.log.gz"))
+	gz := gzip.NewWriter(fh)
+	gz.Write([]byte("3\n"))
+	gz.Close()
+	fh.Close()
+
+	filenames, err := ExpandInputs([]string{filepath.Join(dir, "*.log*")})
+	if err != nil {
+		t.Fatalf("Expand failed: %s", err)
+	}
+
+	if len(filenames) != 2 {
+		t.Fatalf("Expected 2 files, got %v", filenames)
+	}
+
+	if _, err := ExpandInputs([]string{filepath.Join(dir, "*.missing")}); err == nil {
+		t.Errorf("Expected an error for a glob without matches.")
+	}
+
+	reader, _ := NewReader("json", ReadOptions{})
+	objs := make(chan Record, 10)
+	go ReadFiles(reader, filenames, objs)
+
+	var results []string
+
+	iter, _ := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).String())
+		},
+		Iter: "meta.file.slice(meta.file.lastIndexOf('/') + 1) + ':' + meta.line + '=' + i",
+	})
+
+	iter.PreIteration()
+	for rec := range objs {
+		if err := iter.IterRecord(rec); err != nil {
+			t.Fatalf("Iteration failed: %s", err)
+		}
+	}
+
+	expected := []string{"a.log:1=1", "a.log:3=2", "b.log.gz:1=3"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Read %v, expected %v", results, expected)
+	}
+}
@@ -7,42 +7,117 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"strconv"
 	"strings"
-	"unicode"
 )
 
-func Nested_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
-	defer close(objs)
+// ReadOptions controls how the readers decode their input.
+type ReadOptions struct {
+	FailOnException bool
 
-	var dec *json.Decoder = json.NewDecoder(r)
-	var err error
+	// BigInt decodes numbers without going through float64, integers
+	// beyond 2^53 are kept as *big.Int (a javascript BigInt).
+	BigInt bool
 
-	if err == io.EOF {
-		return nil
+	// Path selects the list to iterate in nested documents, as dotted
+	// keys and list indexes, for example "data.items".
+	Path string
+
+	// Delimiter separates the fields of CSV input, NoHeader treats the
+	// first row as data and sends rows as lists instead of objects, and
+	// InferTypes turns numeric and true/false fields into numbers and
+	// booleans.
+	Delimiter  rune
+	NoHeader   bool
+	InferTypes bool
+
+	// Stats counts the rows that failed to parse when set.
+	Stats *Stats
+}
+
+// maxSafeInteger is the largest integer a float64, and so a javascript
+// number, holds exactly.
+const maxSafeInteger = 1 << 53
+
+func newDecoder(r io.Reader, opts ReadOptions) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if opts.BigInt {
+		dec.UseNumber()
 	}
+	return dec
+}
 
-	if err != nil {
-		return err
+// convertNumbers replaces the json.Number values produced by a decoder
+// in UseNumber mode with int64, float64 or *big.Int.
+func convertNumbers(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case json.Number:
+		return convertNumber(string(t))
+	case map[string]interface{}:
+		for k, item := range t {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = converted
+		}
+	case []interface{}:
+		for n, item := range t {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			t[n] = converted
+		}
 	}
+	return v, nil
+}
 
-	handle_object := func() error {
-		var json_obj interface{}
-		err := dec.Decode(&json_obj)
+// convertNumber converts a valid JSON number without losing precision.
+func convertNumber(s string) (interface{}, error) {
+	if strings.ContainsAny(s, ".eE") == false {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n <= maxSafeInteger && n >= -maxSafeInteger {
+			return n, nil
+		}
 
-		if err != nil && failOnException {
-			return err
+		n, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, fmt.Errorf("Invalid number %q", s)
 		}
+		return n, nil
+	}
 
-		objs <- json_obj
+	return strconv.ParseFloat(s, 64)
+}
 
-		return nil
+// Nested_ReadJsonObjectsWithOptions iterates over the items of top level
+// lists and the members of top level objects, members are sent as
+// {"key": key, "value": value}. The input may hold any number of
+// concatenated documents.
+//
+// When opts.Path is set (for example "data.items") the reader streams
+// down to the value at that path in every document and iterates it
+// instead, the rest of the document is skipped token by token.
+func Nested_ReadJsonObjectsWithOptions(objs chan Record, r io.Reader, opts ReadOptions) (err error) {
+	defer close(objs)
+
+	input := &inputErrorReader{r: r}
+	defer countParseError(input, opts, &err)
+
+	reader := nestedReader{
+		dec:  newDecoder(input, opts),
+		objs: objs,
+		opts: opts,
 	}
 
-	var handle_list func() error
+	var path []string
+	if len(opts.Path) > 0 {
+		path = strings.Split(opts.Path, ".")
+	}
 
-	handle_list = func() error {
-		token, err := dec.Token()
+	for {
+		token, err := reader.dec.Token()
 
 		if err == io.EOF {
 			return nil
@@ -52,34 +127,210 @@ func Nested_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnEx
 			return err
 		}
 
-		switch token.(type) {
-		case json.Delim:
-			char := token.(json.Delim).String()
-			if char[0] == '[' {
-				for dec.More() {
-					err = handle_object()
+		if path == nil {
+			err = reader.iterate(token)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
-					if err != nil {
-						return err
-					}
-				}
+		found, err := reader.walk(token, path)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			if opts.FailOnException {
+				return fmt.Errorf("Path %s not found", opts.Path)
+			}
+			log.Printf("path %s not found in document", opts.Path)
+			opts.Stats.Add(ParseError)
+		}
+	}
+}
+
+// inputErrorReader keeps the error reading r, to tell it apart from the
+// errors of parsing what was read.
+type inputErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *inputErrorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// countParseError counts *err as a parse error of a document, the
+// streaming readers can't continue after one. Errors reading input are
+// not counted.
+func countParseError(input *inputErrorReader, opts ReadOptions, err *error) {
+	if *err != nil && (input.err == nil || !errors.Is(*err, input.err)) {
+		log.Printf("json_decode_err: %s", *err)
+		opts.Stats.Add(ParseError)
+	}
+}
+
+type nestedReader struct {
+	dec   *json.Decoder
+	objs  chan Record
+	opts  ReadOptions
+	count int
+}
+
+func (n *nestedReader) send(value interface{}) {
+	n.count += 1
+	n.objs <- Record{Line: n.count, Value: value}
+}
+
+func (n *nestedReader) decode() (interface{}, error) {
+	var json_obj interface{}
+	if err := n.dec.Decode(&json_obj); err != nil {
+		return nil, err
+	}
+
+	if n.opts.BigInt {
+		return convertNumbers(json_obj)
+	}
+	return json_obj, nil
+}
+
+// iterate sends every item of the list, or member of the object, that
+// starts with token.
+func (n *nestedReader) iterate(token json.Token) error {
+	switch token {
+	case json.Delim('['):
+		for n.dec.More() {
+			json_obj, err := n.decode()
+			if err != nil {
+				return err
+			}
+
+			n.send(json_obj)
+		}
+	case json.Delim('{'):
+		for n.dec.More() {
+			key, err := n.dec.Token()
+			if err != nil {
+				return err
+			}
+
+			value, err := n.decode()
+			if err != nil {
+				return err
+			}
+
+			n.send(map[string]interface{}{
+				"key":   key,
+				"value": value,
+			})
+		}
+	default:
+		return errors.New("Nested input must be a [] or {}")
+	}
+
+	// Consume the closing ] or }.
+	_, err := n.dec.Token()
+	return err
+}
+
+// walk follows path down from the value that starts with token and
+// iterates the value at its end, everything else is skipped. Path
+// segments are object keys or list indexes.
+func (n *nestedReader) walk(token json.Token, path []string) (bool, error) {
+	if len(path) == 0 {
+		return true, n.iterate(token)
+	}
+
+	found := false
+	index, indexErr := strconv.Atoi(path[0])
+
+	switch token {
+	case json.Delim('['):
+		for item := 0; n.dec.More(); item += 1 {
+			value, err := n.dec.Token()
+			if err != nil {
+				return false, err
+			}
+
+			if !found && indexErr == nil && item == index {
+				found, err = n.walk(value, path[1:])
+			} else {
+				err = n.skip(value)
+			}
+
+			if err != nil {
+				return false, err
+			}
+		}
+	case json.Delim('{'):
+		for n.dec.More() {
+			key, err := n.dec.Token()
+			if err != nil {
+				return false, err
+			}
+
+			value, err := n.dec.Token()
+			if err != nil {
+				return false, err
+			}
+
+			if !found && key == path[0] {
+				found, err = n.walk(value, path[1:])
 			} else {
-				return errors.New("Nested input must start with a [")
+				err = n.skip(value)
+			}
+
+			if err != nil {
+				return false, err
 			}
-		default:
-			return errors.New("Data is not nested in a list.")
 		}
+	default:
+		// A scalar has nothing below it.
+		return false, nil
+	}
+
+	// Consume the closing ] or }.
+	_, err := n.dec.Token()
+	return found, err
+}
+
+// skip consumes the rest of the value that starts with token.
+func (n *nestedReader) skip(token json.Token) error {
+	if token != json.Delim('[') && token != json.Delim('{') {
 		return nil
 	}
 
-	return handle_list()
+	for depth := 1; depth > 0; {
+		token, err := n.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case json.Delim('['), json.Delim('{'):
+			depth += 1
+		case json.Delim(']'), json.Delim('}'):
+			depth -= 1
+		}
+	}
+
+	return nil
 }
 
-func Flatten_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
+func Flatten_ReadJsonObjectsWithOptions(objs chan Record, r io.Reader, opts ReadOptions) (err error) {
 	defer close(objs)
 
-	var dec *json.Decoder = json.NewDecoder(r)
-	var err error
+	input := &inputErrorReader{r: r}
+	defer countParseError(input, opts, &err)
+
+	var count int
+
+	var dec *json.Decoder = newDecoder(input, opts)
 
 	if err == io.EOF {
 		return nil
@@ -115,8 +366,18 @@ func Flatten_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnE
 				} else {
 					return errors.New("Nested input must start with a [")
 				}
+			case json.Number:
+				value, err := convertNumber(string(token.(json.Number)))
+
+				if err != nil {
+					return err
+				}
+
+				count += 1
+				objs <- Record{Line: count, Value: value}
 			default:
-				objs <- token
+				count += 1
+				objs <- Record{Line: count, Value: token}
 			}
 
 			if dec.More() == false {
@@ -128,15 +389,17 @@ func Flatten_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnE
 	return handle_list()
 }
 
-func ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
+func ReadJsonObjectsWithOptions(objs chan Record, r io.Reader, opts ReadOptions) error {
 	defer close(objs)
 
 	reader := bufio.NewReader(r)
+	var lineNumber int
 
 	for {
 		var readErr error
 
 		line, readErr := reader.ReadString('\n')
+		lineNumber += 1
 
 		if readErr != nil && readErr != io.EOF {
 			return readErr
@@ -154,76 +417,199 @@ func ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException
 			}
 		}
 
-		json_obj, err := LoadLine(line)
+		json_obj, err := loadLine(line, opts)
 
 		if err != nil {
-			log.Printf(fmt.Sprintf("json_decode_err: %s", err))
-			if failOnException {
+			log.Printf("json_decode_err: %s", err)
+			opts.Stats.Add(ParseError)
+			if opts.FailOnException {
 				return err
 			}
-		}
-
-		if json_obj != nil {
-			objs <- json_obj
+		} else {
+			objs <- Record{Line: lineNumber, Value: json_obj}
 		}
 
 		if readErr == io.EOF {
 			return nil
 		}
 	}
+}
 
-	return nil
+// ReadJsonObjectsUntilEOF sends every JSON line of r to objs, see
+// ReadJsonObjectsWithOptions for the other options and line numbers.
+func ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
+	return readValues(ReadJsonObjectsWithOptions, objs, r, ReadOptions{FailOnException: failOnException})
+}
+
+// Nested_ReadJsonObjectsUntilEOF sends the items of the documents of r
+// to objs, see Nested_ReadJsonObjectsWithOptions.
+func Nested_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
+	return readValues(Nested_ReadJsonObjectsWithOptions, objs, r, ReadOptions{FailOnException: failOnException})
+}
+
+// Flatten_ReadJsonObjectsUntilEOF sends the values of the nested lists
+// of r to objs, see Flatten_ReadJsonObjectsWithOptions.
+func Flatten_ReadJsonObjectsUntilEOF(objs chan interface{}, r io.Reader, failOnException bool) error {
+	return readValues(Flatten_ReadJsonObjectsWithOptions, objs, r, ReadOptions{FailOnException: failOnException})
+}
+
+// readValues runs read and sends the values of its records to objs, it
+// closes objs like the readers do.
+func readValues(read ReaderFunc, objs chan interface{}, r io.Reader, opts ReadOptions) error {
+	defer close(objs)
+
+	records := make(chan Record)
+	done := make(chan error, 1)
+	go func() {
+		done <- read(records, r, opts)
+	}()
+
+	for record := range records {
+		objs <- record.Value
+	}
+	return <-done
 }
 
+// LoadLine parses a line holding a single JSON value, any value RFC 8259
+// allows at the top level is accepted. Integers that fit in an int64 are
+// returned as int64, every other number as float64 and null as nil.
 func LoadLine(line string) (interface{}, error) {
-	if line == "true" || line == "false" {
-		var json_obj bool
-		if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
-			return nil, err
-		}
-		return json_obj, nil
-	} else if line[0] == '"' {
+	return loadLine(line, ReadOptions{})
+}
+
+func loadLine(line string, opts ReadOptions) (interface{}, error) {
+	line = strings.TrimPrefix(line, "\ufeff")
+	line = strings.Trim(line, " \t\r\n")
+
+	if len(line) == 0 {
+		return nil, errors.New("Empty line")
+	}
+
+	switch c := line[0]; {
+	case c == 'n':
+		return loadLiteral(line, "null", nil)
+	case c == 't':
+		return loadLiteral(line, "true", true)
+	case c == 'f':
+		return loadLiteral(line, "false", false)
+	case c == '"':
 		var json_obj string
 		if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
 			return nil, err
 		}
 		return json_obj, nil
-	} else if line[0] == '[' {
+	case c == '[' && opts.BigInt, c == '{' && opts.BigInt:
+		return loadBigInt(line)
+	case c == '[':
 		var json_obj []interface{}
 		if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
 			return nil, err
 		}
 		return json_obj, nil
-	} else if line[0] == '{' {
+	case c == '{':
 		var json_obj map[string]interface{} = make(map[string]interface{})
 		if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
 			return nil, err
 		}
 		return json_obj, nil
-	} else if unicode.IsDigit(rune(line[0])) {
-		if strings.Contains(line, ".") {
-			_, err := strconv.ParseFloat(line, 64)
-			if err == nil {
-				var json_obj float64
-				if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
-					return nil, err
-				}
-				return json_obj, nil
-			}
-		} else {
-			_, err := strconv.ParseInt(line, 10, 64)
-			if err == nil {
-				var json_obj int64
-				if err := json.Unmarshal([]byte(line), &json_obj); err != nil {
-					return nil, err
-				}
-				return json_obj, nil
-			}
-		}
-	} else {
-		log.Println("unknown type:", line)
-		return nil, errors.New("Unknown type")
+	case c == '-' || isDigit(c):
+		return loadNumber(line, opts)
 	}
 
+	log.Println("unknown type:", line)
 	return nil, errors.New("Unknown type")
 }
+
+// loadBigInt decodes a list or object without rounding its numbers.
+func loadBigInt(line string) (interface{}, error) {
+	var json_obj interface{}
+
+	dec := newDecoder(strings.NewReader(line), ReadOptions{BigInt: true})
+	if err := dec.Decode(&json_obj); err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("Invalid trailing data after JSON value")
+	}
+
+	return convertNumbers(json_obj)
+}
+
+func loadLiteral(line string, literal string, value interface{}) (interface{}, error) {
+	if line != literal {
+		return nil, fmt.Errorf("Invalid literal %q", line)
+	}
+	return value, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// loadNumber follows the number grammar of RFC 8259:
+//
+//	number = [ minus ] int [ frac ] [ exp ]
+func loadNumber(line string, opts ReadOptions) (interface{}, error) {
+	invalid := fmt.Errorf("Invalid number %q", line)
+	integer := true
+	pos := 0
+
+	digits := func() int {
+		start := pos
+		for pos < len(line) && isDigit(line[pos]) {
+			pos += 1
+		}
+		return pos - start
+	}
+
+	if line[pos] == '-' {
+		pos += 1
+	}
+
+	if pos < len(line) && line[pos] == '0' {
+		pos += 1
+	} else if digits() == 0 {
+		return nil, invalid
+	}
+
+	if pos < len(line) && line[pos] == '.' {
+		integer = false
+		pos += 1
+		if digits() == 0 {
+			return nil, invalid
+		}
+	}
+
+	if pos < len(line) && (line[pos] == 'e' || line[pos] == 'E') {
+		integer = false
+		pos += 1
+		if pos < len(line) && (line[pos] == '+' || line[pos] == '-') {
+			pos += 1
+		}
+		if digits() == 0 {
+			return nil, invalid
+		}
+	}
+
+	if pos != len(line) {
+		return nil, invalid
+	}
+
+	if opts.BigInt {
+		return convertNumber(line)
+	}
+
+	if integer {
+		// Integers too large for an int64 fall through to a float.
+		if json_obj, err := strconv.ParseInt(line, 10, 64); err == nil {
+			return json_obj, nil
+		}
+	}
+
+	json_obj, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return nil, err
+	}
+	return json_obj, nil
+}
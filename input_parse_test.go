@@ -0,0 +1,355 @@
+package jsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestLoadLine(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected interface{}
+	}{
+		{"0", int64(0)},
+		{"42", int64(42)},
+		{"-5", int64(-5)},
+		{"-0", int64(0)},
+		{"-0.25", float64(-0.25)},
+		{"3.14", float64(3.14)},
+		{"1e9", float64(1e9)},
+		{"1E+2", float64(100)},
+		{"-2.5e-3", float64(-0.0025)},
+		{"9223372036854775807", int64(9223372036854775807)},
+		{"9223372036854775808", float64(9223372036854775808)},
+		{"null", nil},
+		{"true", true},
+		{"false", false},
+		{`"hello"`, "hello"},
+		{`"esc\"apedé"`, "esc\"apedé"},
+		{`""`, ""},
+		{"[]", []interface{}{}},
+		{"[1, 2, null]", []interface{}{float64(1), float64(2), nil}},
+		{`{"a": 1}`, map[string]interface{}{"a": float64(1)}},
+		{"{}", map[string]interface{}{}},
+
+		// Whitespace around the value.
+		{" 42 ", int64(42)},
+		{"\t-1\r", int64(-1)},
+		{"null\r\n", nil},
+		{"  true\t", true},
+		{"\n[ 1 ,\t2 ]\n", []interface{}{float64(1), float64(2)}},
+		{`  { "a" : "b" }  `, map[string]interface{}{"a": "b"}},
+		{"\ufeff{\"bom\": true}", map[string]interface{}{"bom": true}},
+	}
+
+	for _, c := range cases {
+		result, err := LoadLine(c.line)
+		if err != nil {
+			t.Errorf("LoadLine(%q) failed: %s", c.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(result, c.expected) {
+			t.Errorf("LoadLine(%q) = %#v, expected %#v", c.line, result, c.expected)
+		}
+	}
+}
+
+func TestLoadLine_Invalid(t *testing.T) {
+	cases := []string{
+		"",
+		" \t\r\n",
+		"01",
+		"-",
+		"--1",
+		"+1",
+		"1.",
+		".5",
+		"1e",
+		"1e+",
+		"0x10",
+		"1 2",
+		"1e999",
+		"NaN",
+		"Infinity",
+		"nul",
+		"nulls",
+		"True",
+		"truex",
+		"'single'",
+		`"unterminated`,
+		"[1,",
+		"{",
+		`{"a": 1} x`,
+		"\v1",
+	}
+
+	for _, line := range cases {
+		result, err := LoadLine(line)
+		if err == nil {
+			t.Errorf("LoadLine(%q) = %#v, expected an error", line, result)
+		}
+	}
+}
+
+func TestReadJsonObjectsWithOptions_Scalars(t *testing.T) {
+	input := "1\r\n-5\n\n  null  \n1e9\n\"s\"\nfalse"
+	expected := []interface{}{int64(1), int64(-5), nil, float64(1e9), "s", false}
+
+	objs := make(chan Record, 10)
+	err := ReadJsonObjectsWithOptions(objs, strings.NewReader(input), ReadOptions{FailOnException: true})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	var results []interface{}
+	for obj := range objs {
+		results = append(results, obj.Value)
+	}
+
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Read %#v, expected %#v", results, expected)
+	}
+}
+
+func TestReadJsonObjectsWithOptions_BigInt(t *testing.T) {
+	input := "1311768467294899695\n{\"id\": 1311768467294899695, \"n\": 7, \"f\": 0.5}\n[-9007199254740993, 9007199254740992]\n"
+
+	objs := make(chan Record, 10)
+	err := ReadJsonObjectsWithOptions(objs, strings.NewReader(input), ReadOptions{FailOnException: true, BigInt: true})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	id, _ := new(big.Int).SetString("1311768467294899695", 10)
+	low, _ := new(big.Int).SetString("-9007199254740993", 10)
+	expected := []interface{}{
+		id,
+		map[string]interface{}{"id": id, "n": int64(7), "f": float64(0.5)},
+		[]interface{}{low, int64(9007199254740992)},
+	}
+
+	var results []interface{}
+	for obj := range objs {
+		results = append(results, obj.Value)
+	}
+
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Read %#v, expected %#v", results, expected)
+	}
+}
+
+func TestIterator_BigIntRoundTrip(t *testing.T) {
+	var output bytes.Buffer
+	enc := json.NewEncoder(&output)
+
+	iter, err := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			enc.Encode(i.(goja.Value).Export())
+		},
+		Iter: "{id: i.id, next: i.id + 1n, kind: typeof i.id}",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create iterator.")
+	}
+
+	row, err := loadLine(`{"id": 1311768467294899695}`, ReadOptions{BigInt: true})
+	if err != nil {
+		t.Fatalf("Failed to parse json: %s", err)
+	}
+
+	iter.PreIteration()
+	if err := iter.IterFunc(row); err != nil {
+		t.Fatalf("Iteration failed: %s", err)
+	}
+
+	if output.String() != `{"id":1311768467294899695,"kind":"bigint","next":1311768467294899696}`+"\n" {
+		t.Errorf("BigInt not preserved: %s", output.String())
+	}
+}
+
+func TestReadJsonObjectsUntilEOF(t *testing.T) {
+	cases := []struct {
+		read     func(chan interface{}, io.Reader, bool) error
+		input    string
+		expected []interface{}
+	}{
+		{ReadJsonObjectsUntilEOF, "1\n{\"a\": 2}\n", []interface{}{int64(1), map[string]interface{}{"a": float64(2)}}},
+		{Nested_ReadJsonObjectsUntilEOF, `[1, "b"]`, []interface{}{float64(1), "b"}},
+		{Flatten_ReadJsonObjectsUntilEOF, `[1, [true, ["c"]]]`, []interface{}{float64(1), true, "c"}},
+	}
+
+	for _, c := range cases {
+		objs := make(chan interface{}, 10)
+		err := c.read(objs, strings.NewReader(c.input), true)
+		if err != nil {
+			t.Fatalf("Read of %q failed: %s", c.input, err)
+		}
+
+		var results []interface{}
+		for obj := range objs {
+			results = append(results, obj)
+		}
+
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("Read %#v, expected %#v", results, c.expected)
+		}
+	}
+
+	objs := make(chan interface{}, 10)
+	if err := ReadJsonObjectsUntilEOF(objs, strings.NewReader("nope\n"), true); err == nil {
+		t.Errorf("Expected an error for a broken line.")
+	}
+}
+
+func TestNested_ReadJsonObjectsWithOptions(t *testing.T) {
+	input := `[1, {"a": 2}] {"x": 1, "y": [true]}
+[] {}
+["last"]`
+	expected := []interface{}{
+		float64(1),
+		map[string]interface{}{"a": float64(2)},
+		map[string]interface{}{"key": "x", "value": float64(1)},
+		map[string]interface{}{"key": "y", "value": []interface{}{true}},
+		"last",
+	}
+
+	objs := make(chan Record, 10)
+	err := Nested_ReadJsonObjectsWithOptions(objs, strings.NewReader(input), ReadOptions{FailOnException: true})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	var results []interface{}
+	for obj := range objs {
+		results = append(results, obj.Value)
+	}
+
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Read %#v, expected %#v", results, expected)
+	}
+}
+
+func TestNested_ReadJsonObjectsWithOptions_Scalar(t *testing.T) {
+	objs := make(chan Record, 10)
+	err := Nested_ReadJsonObjectsWithOptions(objs, strings.NewReader(`[1] 2`), ReadOptions{})
+	if err == nil {
+		t.Errorf("Expected an error for a scalar document.")
+	}
+}
+
+func TestNested_ReadJsonObjectsWithOptions_Path(t *testing.T) {
+	input := `{"meta": {"items": ["skip"]}, "data": {"count": 2, "items": [{"id": 1}, {"id": 2}], "after": [[1], {}]}}
+{"data": {"items": [3]}}
+{"data": [{"items": ["first"]}, {"items": ["second"]}]}`
+
+	cases := []struct {
+		path     string
+		expected []interface{}
+	}{
+		{"data.items", []interface{}{
+			map[string]interface{}{"id": float64(1)},
+			map[string]interface{}{"id": float64(2)},
+			float64(3),
+		}},
+		{"data.1.items", []interface{}{"second"}},
+		{"meta", []interface{}{
+			map[string]interface{}{"key": "items", "value": []interface{}{"skip"}},
+		}},
+	}
+
+	for _, c := range cases {
+		objs := make(chan Record, 10)
+		err := Nested_ReadJsonObjectsWithOptions(objs, strings.NewReader(input), ReadOptions{Path: c.path})
+		if err != nil {
+			t.Fatalf("Read %s failed: %s", c.path, err)
+		}
+
+		var results []interface{}
+		for obj := range objs {
+			results = append(results, obj.Value)
+		}
+
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("Read %s %#v, expected %#v", c.path, results, c.expected)
+		}
+	}
+}
+
+func TestCSV_ReadObjectsUntilEOF(t *testing.T) {
+	cases := []struct {
+		input    string
+		opts     ReadOptions
+		expected []interface{}
+	}{
+		{
+			"name,age,admin\nann,31,true\n\"smith, bob\",-2.5,no\n",
+			ReadOptions{InferTypes: true},
+			[]interface{}{
+				map[string]interface{}{"name": "ann", "age": int64(31), "admin": true},
+				map[string]interface{}{"name": "smith, bob", "age": float64(-2.5), "admin": "no"},
+			},
+		},
+		{
+			"name,age\nann,31,extra\nbob\n",
+			ReadOptions{},
+			[]interface{}{
+				map[string]interface{}{"name": "ann", "age": "31", "2": "extra"},
+				map[string]interface{}{"name": "bob"},
+			},
+		},
+		{
+			"a\tb\n1\t\"quoted\" text\n",
+			ReadOptions{Delimiter: '\t', InferTypes: true},
+			[]interface{}{
+				map[string]interface{}{"a": int64(1), "b": "\"quoted\" text"},
+			},
+		},
+		{
+			"\ufeff\"name\",age\nann,31\n",
+			ReadOptions{},
+			[]interface{}{
+				map[string]interface{}{"name": "ann", "age": "31"},
+			},
+		},
+		{
+			"\ufeffname\tage\nann\t31\n",
+			ReadOptions{Delimiter: '\t'},
+			[]interface{}{
+				map[string]interface{}{"name": "ann", "age": "31"},
+			},
+		},
+		{
+			"1;2\n007;x\n",
+			ReadOptions{Delimiter: ';', NoHeader: true, InferTypes: true},
+			[]interface{}{
+				[]interface{}{int64(1), int64(2)},
+				[]interface{}{"007", "x"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		objs := make(chan Record, 10)
+		err := CSV_ReadObjectsUntilEOF(objs, strings.NewReader(c.input), c.opts)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+
+		var results []interface{}
+		for obj := range objs {
+			results = append(results, obj.Value)
+		}
+
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("Read %q %#v, expected %#v", c.input, results, c.expected)
+		}
+	}
+}
@@ -17,11 +17,11 @@ var exampleCmd = &cobra.Command{
 	Long:  `All software has examples.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) > 0 && args[0] == "packages" {
-			fmt.Println(jsl.DEFAULT_JS_CODE)
+			fmt.Print(jsl.DEFAULT_JS_CODE)
 			return
 		} else {
 
-			fmt.Println(`JSL iterates over json data and allows you to run abitrary javascript on it.
+			fmt.Print(`JSL iterates over json data and allows you to run abitrary javascript on it.
 
 Order of operations
   call Pre()
@@ -29,7 +29,8 @@ Order of operations
       if Filter(i) is false then skip
       key = Dedupe(i) skip if key seen before.
       call Iter(i) emit if not undefined
-      call Accum(i)
+      call Accum(i), on the accumulator of group Group(i) when using --group.
+  call Merge(a, b) to combine worker accumulators when using --par.
   call Post() emit if user defined.
 
 For more information about packages and external javascript files use:
@@ -47,6 +48,12 @@ Examples:
 
   4) Count the number of lines:
      jsl --pre="{count:0}" --accum="accum.count+=1" --post="accum.count"
+
+  5) Count the number of lines using 4 workers:
+     jsl --par=4 --pre="{count:0}" --accum="accum.count+=1" --merge="{count: a.count+b.count}" --post="accum.count"
+
+  6) 99th percentile of the ms field:
+     jsl --pre="{p: percentile(99)}" --accum="accum.p.add(i.ms)" --post="accum.p.value()"
 `)
 		}
 	},
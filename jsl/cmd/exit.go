@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+)
+
+// Exit codes of jsl, see the README.
+const (
+	EXIT_OK      = 0
+	EXIT_RUNTIME = 1 // javascript error with --fail, or over the error budget.
+	EXIT_USAGE   = 2 // bad flags or flag combinations.
+	EXIT_INPUT   = 3 // input missing, unreadable or failing to parse with --fail.
+	EXIT_SCRIPT  = 4 // javascript that does not compile, or a --src that fails to load.
+	EXIT_OUTPUT  = 5 // results, errors or dedupe keys could not be written.
+)
+
+// ExitError is an error that ends the run with Code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode is the exit code for err, errors that are not ExitErrors are
+// runtime errors.
+func ExitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return EXIT_RUNTIME
+}
+
+func exitError(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+func usageError(err error) error {
+	return exitError(EXIT_USAGE, err)
+}
+
+func inputError(err error) error {
+	return exitError(EXIT_INPUT, err)
+}
+
+func scriptError(err error) error {
+	return exitError(EXIT_SCRIPT, err)
+}
+
+func runtimeError(err error) error {
+	return exitError(EXIT_RUNTIME, err)
+}
+
+func outputError(err error) error {
+	return exitError(EXIT_OUTPUT, err)
+}
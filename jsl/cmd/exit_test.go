@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{nil, EXIT_OK},
+		{errors.New("boom"), EXIT_RUNTIME},
+		{runtimeError(errors.New("boom")), EXIT_RUNTIME},
+		{usageError(errors.New("bad flag")), EXIT_USAGE},
+		{inputError(errors.New("missing")), EXIT_INPUT},
+		{scriptError(errors.New("syntax")), EXIT_SCRIPT},
+		{outputError(errors.New("full disk")), EXIT_OUTPUT},
+		{fmt.Errorf("wrapped: %w", inputError(errors.New("missing"))), EXIT_INPUT},
+	}
+
+	for _, c := range cases {
+		if code := ExitCode(c.err); code != c.code {
+			t.Errorf("ExitCode(%v) = %d, expected %d", c.err, code, c.code)
+		}
+	}
+
+	if outputError(nil) != nil {
+		t.Errorf("Expected no error for a nil error.")
+	}
+}
+
+// resetFlags puts every flag back to its default between runs of
+// RootCmd, the flags are package variables.
+func resetFlags() {
+	RootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+}
+
+func TestRootCmd_ExitCodes(t *testing.T) {
+	dir := t.TempDir()
+
+	input := filepath.Join(dir, "input.json")
+	ioutil.WriteFile(input, []byte("{\"a\": 1}\n{\"a\": 2}\n"), 0644)
+	output := filepath.Join(dir, "output.json")
+
+	cases := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"ok", []string{"--iter", "i.a"}, EXIT_OK},
+		{"bad flag", []string{"--no-such-flag"}, EXIT_USAGE},
+		{"bad flag combination", []string{"--par", "2", "--emit-every", "1s"}, EXIT_USAGE},
+		{"missing input", []string{"--input", filepath.Join(dir, "missing.json")}, EXIT_INPUT},
+		{"syntax error", []string{"--iter", "i.a +"}, EXIT_SCRIPT},
+		{"fail", []string{"--fail", "--iter", "i.b.c"}, EXIT_RUNTIME},
+		{"unwritable output", []string{"--output", filepath.Join(dir, "missing", "output.json")}, EXIT_OUTPUT},
+	}
+
+	for _, c := range cases {
+		resetFlags()
+
+		args := append([]string{"--input", input, "--output", output}, c.args...)
+		RootCmd.SetArgs(args)
+
+		err := RootCmd.Execute()
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d (%v), expected %d", c.name, code, err, c.code)
+		}
+	}
+	resetFlags()
+}
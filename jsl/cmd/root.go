@@ -2,13 +2,17 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
-	"sync"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dop251/goja"
@@ -24,32 +28,82 @@ var filterCode string
 var srcFilename string
 var dedupeCode string
 var wrapCode string
+var mergeCode string
+var groupCode string
+var dedupeMax int
+var dedupeTTL time.Duration
+var dedupeBloom int
+var dedupeFalsePositive float64
+var dedupeStore string
 
 var debugMode bool
 var jsonEncode bool
 var asText bool
-var parallelExecution bool
+var parallelWorkers int
+var orderedOutput bool
+var reorderSize int
 var failOnException bool
+var errorsFilename string
+var maxErrors int
+var maxErrorRate float64
 var dataIsNested bool
 var dataShouldFlatten bool
+var decodeBigInt bool
+var nestedPath string
+var inputFormat string
+var csvDelimiter string
+var csvNoHeader bool
+var csvInferTypes bool
+var outputFormat string
+var outputColumns []string
 
 var outputFilename string
-var inputFilename string
+var inputFilenames []string
 var appendFilename string
+var outputCompress string
+var partitionCode string
+var partitionMaxOpen int
+var followInput bool
+var followPoll time.Duration
+var emitEvery time.Duration
+var windowCount int
+var windowTime time.Duration
+var windowSlide string
+var windowTimestamp string
 
 var stats bool
+var statsJSON bool
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError(err)
+	})
+
 	RootCmd.PersistentFlags().BoolVar(&debugMode, "debug", false, "enable debug mode (prints to stderr)")
 	RootCmd.PersistentFlags().BoolVar(&jsonEncode, "json", true, "JSON.stringify results.")
 	RootCmd.PersistentFlags().BoolVar(&asText, "text", false, "Output as text, not encoded JSON.")
 	RootCmd.PersistentFlags().BoolVar(&failOnException, "fail", false, "Stop iteration on uncaught javascript exception")
-	RootCmd.PersistentFlags().BoolVar(&dataIsNested, "nested", false, "input is either a [] or {} and each item should be an iter step.")
+	RootCmd.PersistentFlags().IntVar(&maxErrors, "max-errors", 0, "stop with an error exit code after more than N javascript errors.")
+	RootCmd.PersistentFlags().Float64Var(&maxErrorRate, "max-error-rate", 0, "stop with an error exit code once more than this share of rows failed (0.01), checked after 100 rows and at the end.")
+	RootCmd.PersistentFlags().BoolVar(&stats, "stats", false, "print rows read, filtered, deduped, failed and emitted and the time spent in each stage to stderr.")
+	RootCmd.PersistentFlags().BoolVar(&statsJSON, "stats-json", false, "like --stats, as a line of json.")
+	RootCmd.PersistentFlags().StringVar(&errorsFilename, "errors-to", "", "write errors as json lines with their stage, file, line, stack and the failed record.")
+	RootCmd.PersistentFlags().BoolVar(&dataIsNested, "nested", false, "input is one or more [] or {} documents, each item (or {key, value} member) is an iter step.")
 	RootCmd.PersistentFlags().BoolVar(&dataShouldFlatten, "flatten", false, "flatten all sub lists [1,[2],[3,4]] -> [1,2,3,4]")
-
-	//RootCmd.PersistentFlags().BoolVar(&parallelExecution, "par", false, "Parallel execution (does not preserve order).")
+	RootCmd.PersistentFlags().StringVar(&inputFormat, "input-format", "json", "format of the input: "+strings.Join(jsl.ReaderFormats(), ", ")+".")
+	RootCmd.PersistentFlags().StringVar(&csvDelimiter, "delimiter", "", "field delimiter for csv input (default , for csv and tab for tsv).")
+	RootCmd.PersistentFlags().BoolVar(&csvNoHeader, "no-header", false, "csv input has no header row, rows are lists instead of objects.")
+	RootCmd.PersistentFlags().BoolVar(&csvInferTypes, "infer", false, "turn numeric and true/false csv fields into numbers and booleans.")
+	RootCmd.PersistentFlags().StringVar(&outputFormat, "output-format", "json", "format of the results: "+strings.Join(jsl.WriterFormats(), ", ")+".")
+	RootCmd.PersistentFlags().StringSliceVar(&outputColumns, "columns", nil, "columns of csv output, nested keys as a.b (default keys of the first result).")
+	RootCmd.PersistentFlags().StringVar(&nestedPath, "path", "", "iterate the list at this dotted path of each document (data.items), implies --nested.")
+	RootCmd.PersistentFlags().BoolVar(&decodeBigInt, "bigint", false, "keep integers beyond 2^53 exact as javascript BigInt values.")
+
+	RootCmd.PersistentFlags().IntVar(&parallelWorkers, "par", 1, "number of parallel workers, 0 uses every cpu (does not preserve order).")
+	RootCmd.PersistentFlags().BoolVar(&orderedOutput, "ordered", false, "emit results of parallel workers in input order.")
+	RootCmd.PersistentFlags().IntVar(&reorderSize, "reorder-buffer", jsl.DEFAULT_REORDER_SIZE, "max rows held back waiting on slower workers with --ordered.")
 
 	// command line options for code.
 	RootCmd.PersistentFlags().StringVar(&iterCode, "iter", "", "javascript to run on every iteration (i is iter variable)")
@@ -58,12 +112,29 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&postCode, "post", "", "code to run on the accumulator at end of iteration.")
 	RootCmd.PersistentFlags().StringVar(&filterCode, "filter", "", "filter out falsy results, pass truthy rows to iter")
 	RootCmd.PersistentFlags().StringVar(&dedupeCode, "dedupe", "", "extract key and only emit result for key once.")
+	RootCmd.PersistentFlags().IntVar(&windowCount, "window-count", 0, "run post and start over with pre every N accumulated rows.")
+	RootCmd.PersistentFlags().DurationVar(&windowTime, "window-time", 0, "run post and start over with pre every window of time (10s, 1m).")
+	RootCmd.PersistentFlags().StringVar(&windowSlide, "window-slide", "", "start a window every N rows or duration, overlapping windows when shorter than the window.")
+	RootCmd.PersistentFlags().StringVar(&windowTimestamp, "window-timestamp", "", "time of each row (i) for --window-time, a Date, date string or ms since epoch (default wall clock).")
+	RootCmd.PersistentFlags().StringVar(&groupCode, "group", "", "key of each row, accum runs on a separate pre() accumulator per key and post on each as post(accum, key).")
+	RootCmd.PersistentFlags().IntVar(&dedupeMax, "dedupe-max", 0, "only remember the N most recently seen dedupe keys.")
+	RootCmd.PersistentFlags().DurationVar(&dedupeTTL, "dedupe-ttl", 0, "forget dedupe keys this long after they were first seen (1h, 24h).")
+	RootCmd.PersistentFlags().IntVar(&dedupeBloom, "dedupe-bloom", 0, "remember dedupe keys in a bloom filter sized for N keys, some new keys are wrongly skipped.")
+	RootCmd.PersistentFlags().Float64Var(&dedupeFalsePositive, "dedupe-fp", jsl.DEFAULT_BLOOM_FALSE_POSITIVE_RATE, "share of new keys wrongly skipped by --dedupe-bloom.")
+	RootCmd.PersistentFlags().StringVar(&dedupeStore, "dedupe-store", "", "file of dedupe keys kept across runs, keys in it are skipped and new keys added, needs --dedupe-max, --dedupe-ttl or --dedupe-bloom.")
+	RootCmd.PersistentFlags().StringVar(&mergeCode, "merge", "", "code to combine the accumulators a and b of parallel workers.")
 	RootCmd.PersistentFlags().StringVar(&srcFilename, "src", "", "preload javascript file into vm")
 
 	RootCmd.PersistentFlags().StringVar(&outputFilename, "output", "", "output filename for results (default stdout)")
-	RootCmd.PersistentFlags().StringVar(&inputFilename, "input", "", "input filename for results (default stdin)")
+	RootCmd.PersistentFlags().StringArrayVar(&inputFilenames, "input", nil, "input filename or glob, repeat for more files (default stdin)")
+	RootCmd.PersistentFlags().BoolVar(&followInput, "follow", false, "keep reading the last input file as it grows (handles truncation and rotation), ctrl-c runs post and stops.")
+	RootCmd.PersistentFlags().DurationVar(&followPoll, "follow-poll", jsl.DEFAULT_FOLLOW_POLL, "how often to check a followed file for new lines.")
+	RootCmd.PersistentFlags().DurationVar(&emitEvery, "emit-every", 0, "run post on the accumulator so far at this interval (10s, 1m), needs --par=1.")
 
 	RootCmd.PersistentFlags().StringVar(&appendFilename, "append", "", "append to output file instead of creating new result set.")
+	RootCmd.PersistentFlags().StringVar(&partitionCode, "partition", "", "split results into files by this key (i is the result), --output names the files with {key}.")
+	RootCmd.PersistentFlags().IntVar(&partitionMaxOpen, "partition-max-open", jsl.DEFAULT_PARTITION_MAX_OPEN, "max partition files kept open at once.")
+	RootCmd.PersistentFlags().StringVar(&outputCompress, "output-compress", "", "compress results with gzip or zstd (default from the .gz or .zst output extension).")
 
 }
 
@@ -77,7 +148,44 @@ func initConfig() {
 	log.Printf("Starting run %s\n", time.Now())
 }
 
-func BuildConfigFromOptions() *jsl.IterConfig {
+// exportResult returns the go value of a result, a goja.Runtime is not
+// safe to share between goroutines. Text output keeps the javascript
+// toString of results.
+func exportResult(i interface{}) interface{} {
+	value, ok := i.(goja.Value)
+	if !ok {
+		return i
+	}
+
+	if OutputFormatName() == "text" {
+		return value.String()
+	}
+	return jsl.ExportValue(value)
+}
+
+func BuildConfigFromOptions() (*jsl.IterConfig, error) {
+	window := jsl.WindowConfig{
+		Count:     windowCount,
+		Time:      windowTime,
+		Timestamp: windowTimestamp,
+	}
+
+	if len(windowSlide) > 0 {
+		if windowCount > 0 {
+			slide, err := strconv.Atoi(windowSlide)
+			if err != nil {
+				return nil, fmt.Errorf("--window-slide must be a number of rows with --window-count: %s", err)
+			}
+			window.CountSlide = slide
+		} else {
+			slide, err := time.ParseDuration(windowSlide)
+			if err != nil {
+				return nil, fmt.Errorf("--window-slide must be a duration with --window-time: %s", err)
+			}
+			window.TimeSlide = slide
+		}
+	}
+
 	return &jsl.IterConfig{
 		Iter:            iterCode,
 		Accumulator:     accumCode,
@@ -85,51 +193,205 @@ func BuildConfigFromOptions() *jsl.IterConfig {
 		Pre:             preCode,
 		Post:            postCode,
 		Dedupe:          dedupeCode,
+		Merge:           mergeCode,
+		Group:           groupCode,
 		LibraryFilename: srcFilename,
+		Window:          window,
+	}, nil
+}
+
+// InputFormatName resolves the reader format from --input-format and the
+// older --nested and --flatten flags.
+func InputFormatName() string {
+	if inputFormat == "json" {
+		if dataIsNested || len(nestedPath) > 0 {
+			return "nested"
+		} else if dataShouldFlatten {
+			return "flatten"
+		}
 	}
+	return inputFormat
+}
+
+// OutputFormatName resolves the writer format from --output-format and
+// the older --json and --text flags.
+func OutputFormatName() string {
+	if outputFormat == "json" && (asText || !jsonEncode) {
+		return "text"
+	}
+	return outputFormat
 }
 
 var RootCmd = &cobra.Command{
-	Use:   "jsl",
+	Use:   "jsl [flags] [input files...]",
 	Short: "iterate over json data and run javascript on it.",
 	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  cobra.ArbitraryArgs,
+
+	// main reports errors, with the exit code for their kind.
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Usage is only printed for flag parsing errors.
+		cmd.SilenceUsage = true
+
 		BUFFER_LEN := 0
 
-		config := BuildConfigFromOptions()
+		config, err := BuildConfigFromOptions()
+		if err != nil {
+			return usageError(err)
+		}
+
+		err = config.Window.Validate()
+		if err != nil {
+			return usageError(err)
+		}
+
+		// Lets do the actual processing.
+		WORKER_COUNT := parallelWorkers
+		if WORKER_COUNT < 1 {
+			WORKER_COUNT = runtime.NumCPU()
+		}
+
+		if emitEvery > 0 && WORKER_COUNT > 1 {
+			return usageError(fmt.Errorf("--emit-every needs a single worker, got --par=%d", WORKER_COUNT))
+		}
+
+		if config.Window.Enabled() && WORKER_COUNT > 1 {
+			return usageError(fmt.Errorf("windows need a single worker, got --par=%d", WORKER_COUNT))
+		}
+
+		dedupe_config := jsl.DedupeConfig{
+			MaxKeys:           dedupeMax,
+			TTL:               dedupeTTL,
+			BloomKeys:         dedupeBloom,
+			FalsePositiveRate: dedupeFalsePositive,
+			Store:             dedupeStore,
+		}
+
+		err = dedupe_config.Validate()
+		if err != nil {
+			return usageError(err)
+		}
+
+		var run_stats *jsl.Stats
+		if stats || statsJSON {
+			run_stats = jsl.NewStats()
+			config.Stats = run_stats
+		}
+
+		read_options := jsl.ReadOptions{
+			FailOnException: failOnException,
+			BigInt:          decodeBigInt,
+			Path:            nestedPath,
+			NoHeader:        csvNoHeader,
+			InferTypes:      csvInferTypes,
+			Stats:           run_stats,
+		}
+
+		if len(csvDelimiter) > 0 {
+			delimiter := []rune(csvDelimiter)
+			if len(delimiter) != 1 {
+				return usageError(fmt.Errorf("delimiter must be a single character, got %q", csvDelimiter))
+			}
+			read_options.Delimiter = delimiter[0]
+		}
+
+		record_reader, err := jsl.NewReader(InputFormatName(), read_options)
+		if err != nil {
+			return usageError(err)
+		}
+
+		write_options := jsl.WriteOptions{
+			Columns: outputColumns,
+		}
+
+		if _, err := jsl.NewWriter(OutputFormatName(), ioutil.Discard, write_options); err != nil {
+			return usageError(err)
+		}
+
+		// Scripts are compiled once up front so mistakes are reported
+		// before any input is read or output written.
+		if _, err := jsl.NewIterator(config); err != nil {
+			return scriptError(err)
+		}
 
 		// Start the reader.
 
-		var input_reader io.Reader
-		if len(inputFilename) > 0 {
-			if _, err := os.Stat(inputFilename); os.IsNotExist(err) {
-				fmt.Errorf("input file %s does not exist.", inputFilename)
+		input_files, err := jsl.ExpandInputs(append(inputFilenames, args...))
+		if err != nil {
+			return inputError(err)
+		}
+
+		for _, filename := range input_files {
+			if filename == jsl.STDIN_FILENAME {
+				continue
 			}
 
-			fh, err := os.Open(inputFilename)
-			if err != nil {
-				panic(err)
+			if _, err := os.Stat(filename); err != nil {
+				return inputError(fmt.Errorf("input file %s: %w", filename, err))
 			}
-			defer fh.Close()
-			input_reader = fh
-		} else {
+		}
+
+		if len(input_files) == 0 {
 			log.Printf("Reading from stdin...")
-			input_reader = os.Stdin
 		}
 
-		parsed_objects := make(chan interface{}, BUFFER_LEN)
+		deduper, err := jsl.NewDeduper(dedupe_config)
+		if err != nil {
+			return inputError(err)
+		}
+		config.Deduper = deduper
+
+		read_objects := make(chan jsl.Record, BUFFER_LEN)
+		parsed_objects := make(chan jsl.Record, BUFFER_LEN)
 		// Reader is ready.
 
 		// iterators read and pass valid objects to output
 		output_objects := make(chan interface{}, BUFFER_LEN)
 
+		// Runs on the worker that emitted i, results leave its VM before
+		// the output goroutine gets them.
 		config.Emitter = func(i interface{}) {
-			output_objects <- i
+			output_objects <- exportResult(i)
+		}
+
+		parallel_config := jsl.ParallelConfig{
+			Workers:     WORKER_COUNT,
+			FailOnError: failOnException,
+			Ordered:     orderedOutput,
+			ReorderSize: reorderSize,
+			EmitEvery:   emitEvery,
+			Export:      exportResult,
+			Budget: jsl.ErrorBudget{
+				MaxErrors:    maxErrors,
+				MaxErrorRate: maxErrorRate,
+			},
 		}
 
+		var errorsFileHandle *os.File
+		if len(errorsFilename) > 0 {
+			errorsFileHandle, err = os.Create(errorsFilename)
+			if err != nil {
+				deduper.Close()
+				return outputError(err)
+			}
+
+			error_writer := jsl.NewErrorWriter(errorsFileHandle)
+			parallel_config.OnError = func(err error) {
+				log.Println("debug", err)
+				if write_err := error_writer.Write(err); write_err != nil {
+					log.Println("errors", write_err)
+				}
+			}
+		}
+
+		// Results that can't be written count as failed rows too.
+		error_handler := jsl.NewErrorHandler(parallel_config, run_stats)
+		parallel_config.Errors = error_handler
+
 		var output_writer io.Writer
 		var filename string
-		file_mode := os.O_CREATE | os.O_WRONLY
+		file_mode := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
 
 		if len(outputFilename) > 0 {
 			filename = outputFilename
@@ -139,99 +401,256 @@ var RootCmd = &cobra.Command{
 		}
 
 		var outputFileHandle *os.File
-
-		if len(filename) > 0 {
-			outputFileHandle, err := os.OpenFile(filename, file_mode, 0644)
+		var record_writer jsl.RecordWriter
+		var output_closer io.Closer
+		var output_compressor io.WriteCloser
+
+		if len(partitionCode) > 0 {
+			partition_writer, err := jsl.NewPartitionWriter(jsl.PartitionConfig{
+				Expression:  partitionCode,
+				Path:        filename,
+				Compression: outputCompress,
+				Format:      OutputFormatName(),
+				Options:     write_options,
+				MaxOpen:     partitionMaxOpen,
+				Append:      file_mode&os.O_APPEND != 0,
+			})
 			if err != nil {
-				panic(err)
+				closeAll(deduper, errorsFileHandle)
+				var script_err *jsl.ScriptError
+				if errors.As(err, &script_err) {
+					return scriptError(err)
+				}
+				return usageError(err)
 			}
-			output_writer = outputFileHandle
-		} else {
-			output_writer = os.Stdout
-		}
 
-		output_done := make(chan bool, 0)
-		go func() {
-			if jsonEncode && !asText {
-				enc := json.NewEncoder(output_writer)
-				for i := range output_objects {
-					enc.Encode(i.(goja.Value).Export())
+			record_writer = partition_writer
+			output_closer = partition_writer
+		} else {
+			if len(filename) > 0 {
+				outputFileHandle, err = os.OpenFile(filename, file_mode, 0644)
+				if err != nil {
+					closeAll(deduper, errorsFileHandle)
+					return outputError(err)
 				}
+				output_writer = outputFileHandle
 			} else {
-				for i := range output_objects {
-					fmt.Fprintln(output_writer, i)
-				}
+				output_writer = os.Stdout
 			}
-			close(output_done)
-		}()
-		// done with handling output of iterator and sending to stdout.
-
-		// Lets do the actual processing.
-		WORKER_COUNT := 1
-		if parallelExecution {
-			WORKER_COUNT = runtime.NumCPU()
-		}
-
-		wg := sync.WaitGroup{}
 
-		for i := 0; i < WORKER_COUNT; i += 1 {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+			compression := outputCompress
+			if len(compression) == 0 {
+				compression = jsl.CompressionFromFilename(filename)
+			}
 
-				iter, err := jsl.NewIterator(config)
+			output_compressor, err = jsl.Compress(output_writer, compression)
+			if err != nil {
+				closeAll(deduper, errorsFileHandle, outputFileHandle)
+				return usageError(err)
+			}
+			output_writer = output_compressor
+			output_closer = output_compressor
 
+			// Appending to csv or tsv keeps the header and columns the
+			// file already has.
+			if file_mode&os.O_APPEND != 0 {
+				write_options, err = jsl.AppendOptions(filename, OutputFormatName(), write_options)
 				if err != nil {
-					panic(err)
+					closeAll(deduper, errorsFileHandle, output_closer, outputFileHandle)
+					return outputError(err)
 				}
+			}
 
-				err = iter.PreIteration()
+			record_writer, err = jsl.NewWriter(OutputFormatName(), output_writer, write_options)
+			if err != nil {
+				closeAll(deduper, errorsFileHandle, output_closer, outputFileHandle)
+				return usageError(err)
+			}
+		}
 
+		// output_err is the first error writing results, it is read once
+		// output_done is closed.
+		var output_err error
+		output_done := make(chan bool, 0)
+		go func() {
+			keep := func(err error) {
 				if err != nil {
-					panic(err)
+					log.Println("output", err)
+					if output_err == nil {
+						output_err = err
+					}
 				}
+			}
 
-				for obj := range parsed_objects {
-					err := iter.IterFunc(obj)
-					if err != nil {
-						if failOnException {
-							log.Println("fail", err)
-							return
-						} else if debugMode {
-							log.Println("debug", err)
-						}
+			// Results of followed input are flushed every poll, through
+			// the writer and the compressor, so they show up as they
+			// happen.
+			var flush_tick <-chan time.Time
+			if followInput {
+				ticker := time.NewTicker(followPoll)
+				defer ticker.Stop()
+				flush_tick = ticker.C
+			}
+
+			flush := func() {
+				keep(record_writer.Flush())
+				keep(jsl.FlushCompressed(output_compressor))
+			}
+
+			written := false
+			for {
+				select {
+				case i, ok := <-output_objects:
+					if !ok {
+						keep(record_writer.Flush())
+						close(output_done)
+						return
 					}
 
+					err := record_writer.WriteRecord(i)
+					if record_err := recordError(i, err); record_err != nil {
+						// Only this result is lost, like a failed row.
+						error_handler.Handle(record_err)
+					} else {
+						keep(err)
+					}
+					written = true
+				case <-flush_tick:
+					if written {
+						flush()
+						written = false
+					}
 				}
+			}
+		}()
+		// done with handling output of iterator and sending to stdout.
 
-				err = iter.PostIteration()
-				if err != nil {
-					panic(err)
+		// finish writes out everything kept so far, also when the run
+		// failed, and returns the first error doing so.
+		finish := func() error {
+			err := deduper.Close()
+
+			close(output_objects)
+			<-output_done
+			if err == nil {
+				err = output_err
+			}
+
+			if close_err := output_closer.Close(); err == nil {
+				err = close_err
+			}
+
+			if outputFileHandle != nil {
+				outputFileHandle.Sync()
+				if close_err := outputFileHandle.Close(); err == nil {
+					err = close_err
 				}
+			}
 
-			}()
+			if errorsFileHandle != nil {
+				if close_err := errorsFileHandle.Close(); err == nil {
+					err = close_err
+				}
+			}
+
+			writeStats(run_stats)
+			return outputError(err)
 		}
 
-		var err error
-		if dataIsNested {
-			err = jsl.Nested_ReadJsonObjectsUntilEOF(parsed_objects, input_reader, failOnException)
-		} else if dataShouldFlatten {
-			err = jsl.Flatten_ReadJsonObjectsUntilEOF(parsed_objects, input_reader, failOnException)
-		} else {
-			err = jsl.ReadJsonObjectsUntilEOF(parsed_objects, input_reader, failOnException)
+		follow_options := jsl.FollowOptions{
+			Follow: followInput,
+			Poll:   followPoll,
+			Stop:   make(chan bool),
 		}
 
+		if followInput {
+			// The first interrupt stops following so post still runs, a
+			// second one exits right away.
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				signal.Stop(interrupts)
+				log.Println("Interrupted, stopping input.")
+				close(follow_options.Stop)
+			}()
+		}
+
+		read_done := make(chan error, 1)
+		go func() {
+			read_done <- jsl.FollowFiles(record_reader, input_files, read_objects, follow_options)
+		}()
+		go jsl.Sequence(read_objects, parsed_objects)
+
+		err = jsl.HandleParallel(config, parallel_config, parsed_objects)
 		if err != nil {
-			panic(err)
+			// The reader may be stuck on a row nobody takes, it is not
+			// waited for.
+			finish()
+			return runtimeError(err)
 		}
 
-		wg.Wait()
-		close(output_objects)
-		<-output_done
+		read_err := <-read_done
+		err = finish()
+
+		// Results written after the workers were done may still have
+		// failed the run.
+		if run_err := error_handler.Err(); run_err != nil {
+			return runtimeError(run_err)
+		}
 
-		if outputFileHandle != nil {
-			outputFileHandle.Sync()
-			outputFileHandle.Close()
+		if read_err != nil {
+			return inputError(read_err)
 		}
+		return err
 	},
 }
+
+// recordError returns err as a StageError holding the result i when it
+// is about a single result that can't be written (it can't be encoded or
+// its partition key throws), and nil when the output itself failed.
+func recordError(i interface{}, err error) error {
+	var value_err *json.UnsupportedValueError
+	var type_err *json.UnsupportedTypeError
+	var marshal_err *json.MarshalerError
+	var stage_err *jsl.StageError
+
+	if errors.As(err, &stage_err) {
+		if stage_err.Record == nil {
+			stage_err.Record = i
+		}
+		return stage_err
+	}
+
+	if errors.As(err, &value_err) || errors.As(err, &type_err) || errors.As(err, &marshal_err) {
+		return &jsl.StageError{Stage: "output", Record: i, Err: err}
+	}
+	return nil
+}
+
+// closeAll closes what was opened before a run fails to start, nil
+// files are skipped.
+func closeAll(closers ...io.Closer) {
+	for _, closer := range closers {
+		if file, ok := closer.(*os.File); ok && file == nil {
+			continue
+		}
+		if closer != nil {
+			closer.Close()
+		}
+	}
+}
+
+// writeStats prints the report of the run to stderr, when it was kept.
+func writeStats(run_stats *jsl.Stats) {
+	if run_stats == nil {
+		return
+	}
+
+	report := run_stats.Report()
+	if statsJSON {
+		json.NewEncoder(os.Stderr).Encode(report)
+	} else {
+		report.WriteText(os.Stderr)
+	}
+}
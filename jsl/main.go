@@ -1,15 +1,23 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"os"
 
+	"github.com/graham/jsl"
 	"github.com/graham/jsl/jsl/cmd"
 )
 
 func main() {
 	if err := cmd.RootCmd.Execute(); err != nil {
-		log.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "jsl:", err)
+
+		var script_err *jsl.ScriptError
+		if errors.As(err, &script_err) {
+			fmt.Fprint(os.Stderr, script_err.Pointer())
+		}
+
+		os.Exit(cmd.ExitCode(err))
 	}
 }
@@ -6,8 +6,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"time"
 
 	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
 )
 
 type IterConfig struct {
@@ -17,8 +21,19 @@ type IterConfig struct {
 	Filter          string
 	Accumulator     string
 	Dedupe          string
+	Merge           string
+	Group           string
 	LibraryFilename string
 	Emitter         func(interface{})
+
+	// Window runs post at window boundaries instead of once at the end.
+	Window WindowConfig
+
+	// Deduper records dedupe keys, every key is kept in memory when nil.
+	Deduper Deduper
+
+	// Stats counts rows and times stages when set.
+	Stats *Stats
 }
 
 type Iterator interface {
@@ -37,6 +52,12 @@ const (
 	FilterTrue  StatType = 2
 	FilterFalse StatType = 3
 	FilterError StatType = 4
+	RowsRead    StatType = 5
+	ParseError  StatType = 6
+	Deduped     StatType = 7
+	Emitted     StatType = 8
+
+	statTypes = 9
 )
 
 const DEFAULT_JS_CODE = `// I recommend piping this to a package.js and editing from there.
@@ -70,30 +91,97 @@ function accumulator(i, accum) {
   return accum;
 }
 
-// Run once at the end of the iteration.
-function post(accum) { 
+// Merge combines the accumulators of two parallel workers
+// (--par) and should return the combined accumulator, post
+// is then run once on the result.
+function merge(a, b) {
+  if (a === undefined || a === null) {
+    return b;
+  }
+  if (b === undefined || b === null) {
+    return a;
+  }
+  if (typeof a === "object" && typeof a.merge === "function") {
+    a.merge(b);
+    return a;
+  }
+  if (typeof a === "number" && typeof b === "number") {
+    return a + b;
+  }
+  if (Array.isArray(a)) {
+    return a.concat(b);
+  }
+  if (typeof a === "object") {
+    for (var k in b) {
+      a[k] = merge(a[k], b[k]);
+    }
+    return a;
+  }
+  return b;
+}
+
+// Run once at the end of the iteration, with --group it is run
+// for every group as post(accum, key).
+function post(accum, key) { 
   return accum;
 }
 `
 
+// The default functions are compiled once and shared by every VM.
+var defaultProgram *goja.Program = goja.MustCompile("default", DEFAULT_JS_CODE, false)
+
 type GojaIterator struct {
 	VM             *goja.Runtime
 	Accumulator    goja.Value
 	Emitter        func(interface{})
-	dedupeMap      map[string]bool
+	dedupeMap      Deduper
 	hasFilter      bool
 	hasAccumulator bool
 	hasIterator    bool
 	hasDedupe      bool
+	hasGroup       bool
+
+	// groupPost runs post for every group instead of on the map of
+	// all groups.
+	groupPost bool
+
+	// Stage functions are resolved once the VM is set up and then
+	// called directly for every row.
+	preFunc         goja.Callable
+	filterFunc      goja.Callable
+	dedupeFunc      goja.Callable
+	iterFunc        goja.Callable
+	accumulatorFunc goja.Callable
+	mergeFunc       goja.Callable
+	postFunc        goja.Callable
+	groupFunc       goja.Callable
+
+	// meta is exposed to javascript, it holds the file and line of the
+	// row being handled.
+	meta *goja.Object
+
+	// window is set for windowed iteration.
+	window *windowState
+
+	stats *Stats
 }
 
 func NewIterator(ic *IterConfig) (*GojaIterator, error) {
 	iter := GojaIterator{
-		dedupeMap: make(map[string]bool, 0),
+		dedupeMap: ic.Deduper,
+		stats:     ic.Stats,
+	}
+	if iter.dedupeMap == nil {
+		iter.dedupeMap = newDedupeSet()
 	}
 	iter.VM = goja.New()
 	iter.Emitter = ic.Emitter
 
+	iter.meta = iter.VM.NewObject()
+	iter.VM.Set("meta", iter.meta)
+
+	registerAggregates(iter.VM)
+
 	iter.VM.Set("print", func(call goja.FunctionCall) goja.Value {
 		var result []byte
 		result, _ = json.Marshal(call)
@@ -101,7 +189,7 @@ func NewIterator(ic *IterConfig) (*GojaIterator, error) {
 		return nil
 	})
 
-	_, err := iter.VM.RunString(DEFAULT_JS_CODE)
+	_, err := iter.VM.RunProgram(defaultProgram)
 
 	if err != nil {
 		panic(err)
@@ -115,15 +203,15 @@ func NewIterator(ic *IterConfig) (*GojaIterator, error) {
 
 		data, err := ioutil.ReadFile(ic.LibraryFilename)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		log.Printf("Loading library file %s (%d)...\n", ic.LibraryFilename, len(data))
 
-		_, lib_err := iter.VM.RunString(string(data))
+		lib_err := iter.define(ic.LibraryFilename, string(data))
 
 		if lib_err != nil {
-			panic(lib_err)
+			return nil, lib_err
 		}
 	} else {
 		if len(ic.Iter) == 0 && len(ic.Accumulator) == 0 {
@@ -133,72 +221,96 @@ func NewIterator(ic *IterConfig) (*GojaIterator, error) {
 
 	if len(ic.Iter) > 0 {
 		iter.hasIterator = true
-		iter.RunString(
-			fmt.Sprintf(
-				"function iter(i, accum) { return %s }",
-				ic.Iter,
-			),
-		)
+		err = iter.defineStage("iter", "function iter(i, accum) { return ", ic.Iter, " }")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(ic.Filter) > 0 {
 		iter.hasFilter = true
-		iter.RunString(
-			fmt.Sprintf(
-				"function filter(i, accum) { return %s }",
-				ic.Filter,
-			),
-		)
+		err = iter.defineStage("filter", "function filter(i, accum) { return ", ic.Filter, " }")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(ic.Accumulator) > 0 {
 		iter.hasAccumulator = true
-		iter.RunString(
-			fmt.Sprintf(
-				"function accumulator(i, accum) { %s; return accum }",
-				ic.Accumulator,
-			),
-		)
+		err = iter.defineStage("accum", "function accumulator(i, accum) { ", ic.Accumulator, "; return accum }")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(ic.Pre) > 0 {
-		iter.RunString(
-			fmt.Sprintf(
-				"function pre() { return %s }",
-				ic.Pre,
-			),
-		)
+		err = iter.defineStage("pre", "function pre() { return ", ic.Pre, " }")
 	} else {
-		iter.RunString("function pre() { return {} }")
+		err = iter.define("pre", "function pre() { return {} }")
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if len(ic.Post) > 0 {
-		iter.RunString(
-			fmt.Sprintf(
-				"function post(accum) { return %s }",
-				ic.Post,
-			),
-		)
+		err = iter.defineStage("post", "function post(accum, key) { return ", ic.Post, " }")
 	} else {
 		if iter.hasAccumulator {
-			iter.RunString(
+			err = iter.define(
+				"post",
 				"function post(accum) { return accum }",
 			)
 		} else {
-			iter.RunString(
+			err = iter.define(
+				"post",
 				"function post(accum) { return null }",
 			)
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	if len(ic.Dedupe) > 0 {
 		iter.hasDedupe = true
-		iter.RunString(
-			fmt.Sprintf(
-				"function dedupe(i) { return %s }",
-				ic.Dedupe,
-			),
-		)
+		err = iter.defineStage("dedupe", "function dedupe(i) { return ", ic.Dedupe, " }")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ic.Merge) > 0 {
+		err = iter.defineStage("merge", "function merge(a, b) { return ", ic.Merge, " }")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ic.Group) > 0 {
+		iter.hasGroup = true
+		iter.groupPost = len(ic.Post) > 0 || len(ic.LibraryFilename) > 0
+		err = iter.defineStage("group", "function group(i, accum) { return ", ic.Group, " }")
+		if err != nil {
+			return nil, err
+		}
+
+		fn, ok := goja.AssertFunction(iter.VM.Get("group"))
+		if !ok {
+			return nil, fmt.Errorf("group is not a function")
+		}
+		iter.groupFunc = fn
+	}
+
+	err = iter.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	if ic.Window.Enabled() {
+		err = iter.setupWindow(ic.Window)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &iter, nil
@@ -208,8 +320,89 @@ func (it *GojaIterator) RunString(s string) (goja.Value, error) {
 	return it.VM.RunString(s)
 }
 
+// define compiles the source of a stage function and runs it in the VM.
+func (it *GojaIterator) define(name string, src string) error {
+	program, err := goja.Compile(name, src, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = it.VM.RunProgram(program)
+	return err
+}
+
+// defineStage defines the function of stage from code given by the
+// user, as prefix + code + suffix. Code that does not compile is a
+// ScriptError pointing into code rather than the wrapping.
+func (it *GojaIterator) defineStage(stage string, prefix string, code string, suffix string) error {
+	if err := checkStage(stage, prefix, code, suffix); err != nil {
+		return err
+	}
+
+	err := it.define(stage, prefix+code+suffix)
+	if err != nil {
+		return &ScriptError{Stage: stage, Code: code, Message: err.Error()}
+	}
+	return nil
+}
+
+// checkStage parses prefix + code + suffix, the declaration of a single
+// function wrapping code. Code has to compile on its own terms: closing
+// the function early to run more code outside of it is an error too.
+func checkStage(stage string, prefix string, code string, suffix string) error {
+	src := prefix + code + suffix
+
+	program, err := parser.ParseFile(nil, stage, src, 0)
+	if list, ok := err.(parser.ErrorList); ok && len(list) > 0 {
+		return newScriptError(stage, prefix, code, list[0])
+	}
+	if err != nil {
+		return &ScriptError{Stage: stage, Code: code, Message: err.Error()}
+	}
+
+	// The function has to end in the suffix, a closing bracket in code
+	// is where it ended instead.
+	if declaration, ok := program.Body[0].(*ast.FunctionDeclaration); ok {
+		end := int(declaration.Function.Body.RightBrace) - program.File.Base()
+		if end < len(prefix)+len(code) {
+			return newScriptError(stage, prefix, code, &parser.Error{
+				Position: program.File.Position(end),
+				Message:  "Unexpected token }",
+			})
+		}
+	}
+
+	return nil
+}
+
+// resolve looks up the stage functions defined in the VM.
+func (it *GojaIterator) resolve() error {
+	stages := []struct {
+		name string
+		fn   *goja.Callable
+	}{
+		{"pre", &it.preFunc},
+		{"filter", &it.filterFunc},
+		{"dedupe", &it.dedupeFunc},
+		{"iter", &it.iterFunc},
+		{"accumulator", &it.accumulatorFunc},
+		{"merge", &it.mergeFunc},
+		{"post", &it.postFunc},
+	}
+
+	for _, stage := range stages {
+		fn, ok := goja.AssertFunction(it.VM.Get(stage.name))
+		if !ok {
+			return fmt.Errorf("%s is not a function", stage.name)
+		}
+		*stage.fn = fn
+	}
+
+	return nil
+}
+
 func (it *GojaIterator) PreIteration() error {
-	value, err := it.VM.RunString("pre()")
+	value, err := it.newAccumulator()
 	if err != nil {
 		return err
 	}
@@ -219,29 +412,207 @@ func (it *GojaIterator) PreIteration() error {
 }
 
 func (it *GojaIterator) PostIteration() error {
-	it.VM.Set("accum", it.Accumulator)
-	value, err := it.VM.RunString("post(accum)")
+	if it.window != nil {
+		// Every window still open is emitted, including partial ones.
+		return it.closeWindows(math.MaxInt64)
+	}
 
+	value, err := it.post()
 	if err != nil {
 		return err
 	}
 
 	it.Accumulator = value
+	return nil
+}
+
+// EmitAccumulator runs post on the current accumulator and emits the
+// result like PostIteration, but keeps the accumulator so iteration can
+// go on. post may still change the accumulator itself, to reset it.
+func (it *GojaIterator) EmitAccumulator() error {
+	_, err := it.post()
+	return err
+}
+
+func (it *GojaIterator) post() (goja.Value, error) {
+	if it.groupPost {
+		return it.Accumulator, it.postGroups()
+	}
+
+	value, err := it.call("post", it.postFunc, it.accum())
+	if err != nil {
+		return nil, err
+	}
+
+	if !goja.IsUndefined(value) && !goja.IsNull(value) {
+		it.emit(value)
+	}
+
+	return value, nil
+}
+
+// postGroups runs post(accum, key) for every group and emits the results.
+func (it *GojaIterator) postGroups() error {
+	groups := it.groups(it.Accumulator)
+
+	for _, key := range groups.Keys() {
+		value, err := it.call("post", it.postFunc, groups.Get(key), it.VM.ToValue(key))
+		if err != nil {
+			return err
+		}
+
+		if !goja.IsUndefined(value) && !goja.IsNull(value) {
+			it.emit(value)
+		}
+	}
 
-	if goja.IsUndefined(value) || goja.IsNull(value) {
+	return nil
+}
+
+// newAccumulator returns the starting accumulator, the result of pre or
+// with groups an empty object that gets a pre() per key.
+func (it *GojaIterator) newAccumulator() (goja.Value, error) {
+	if it.hasGroup {
+		return it.newGroups(), nil
+	}
+	return it.call("pre", it.preFunc)
+}
+
+// newGroups returns an object without a prototype for the group
+// accumulators, so keys like toString or __proto__ are groups like any
+// other rather than inherited members.
+func (it *GojaIterator) newGroups() *goja.Object {
+	return it.VM.CreateObject(nil)
+}
+
+// groups returns the object holding the group accumulators.
+func (it *GojaIterator) groups(accum goja.Value) *goja.Object {
+	if accum == nil || goja.IsUndefined(accum) || goja.IsNull(accum) {
+		return it.newGroups()
+	}
+	return accum.ToObject(it.VM)
+}
+
+// accumulate runs the accumulator for row and returns the new
+// accumulator. With groups only the accumulator of the group of row
+// changes, rows without a group (undefined or null) are skipped.
+func (it *GojaIterator) accumulate(row goja.Value, accum goja.Value) (goja.Value, error) {
+	if !it.hasGroup {
+		return it.call("accum", it.accumulatorFunc, row, accum)
+	}
+
+	groups := it.groups(accum)
+
+	key, err := it.call("group", it.groupFunc, row, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	if goja.IsUndefined(key) || goja.IsNull(key) {
+		return groups, nil
+	}
+
+	state := groups.Get(key.String())
+	if state == nil {
+		state, err = it.call("pre", it.preFunc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state, err = it.call("accum", it.accumulatorFunc, row, state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = groups.Set(key.String(), state)
+	return groups, err
+}
+
+// Merge folds the accumulator of another iterator into this one using
+// merge(a, b). The other iterator must no longer be running, its
+// accumulator is exported out of its own VM before being handed over.
+func (it *GojaIterator) Merge(other *GojaIterator) error {
+	if other.Accumulator == nil {
 		return nil
 	}
 
-	it.Emitter(it.Accumulator)
+	if it.hasGroup {
+		return it.mergeGroups(other)
+	}
+
+	value, err := it.call("merge", it.mergeFunc, it.Accumulator, it.VM.ToValue(other.Accumulator.Export()))
+	if err != nil {
+		return err
+	}
+
+	it.Accumulator = value
+	return nil
+}
+
+// mergeGroups merges the accumulators of groups found in both iterators
+// and takes over the groups only the other one has.
+func (it *GojaIterator) mergeGroups(other *GojaIterator) error {
+	groups := it.groups(it.Accumulator)
+	others := other.groups(other.Accumulator)
+
+	for _, key := range others.Keys() {
+		value := it.VM.ToValue(others.Get(key).Export())
+
+		if state := groups.Get(key); state != nil {
+			merged, err := it.call("merge", it.mergeFunc, state, value)
+			if err != nil {
+				return err
+			}
+			value = merged
+		}
+
+		err := groups.Set(key, value)
+		if err != nil {
+			return err
+		}
+	}
 
+	it.Accumulator = groups
 	return nil
 }
 
+// IterRecord runs IterFunc on the value of rec, with meta.file and
+// meta.line set to where the record was read from.
+func (it *GojaIterator) IterRecord(rec Record) error {
+	it.meta.Set("file", rec.File)
+	it.meta.Set("line", rec.Line)
+
+	err := it.IterFunc(rec.Value)
+	if stageErr, ok := err.(*StageError); ok {
+		stageErr.File = rec.File
+		stageErr.Line = rec.Line
+	}
+	return err
+}
+
+// IterFunc runs the stages for one row, errors are StageErrors holding
+// the row.
 func (it *GojaIterator) IterFunc(i interface{}) error {
-	it.VM.Set("i", i)
-	it.VM.Set("accum", it.Accumulator)
+	it.stats.Add(RowsRead)
+
+	err := it.iterRow(i)
+	if stageErr, ok := err.(*StageError); ok && stageErr.Record == nil {
+		stageErr.Record = i
+	}
+
+	if err != nil {
+		it.stats.Add(IterError)
+	} else {
+		it.stats.Add(IterOk)
+	}
+	return err
+}
+
+func (it *GojaIterator) iterRow(i interface{}) error {
+	row := it.VM.ToValue(i)
 
-	keep, err := it.FilterFunc(i)
+	keep, err := it.filter(row)
 
 	if err != nil {
 		return err
@@ -252,7 +623,7 @@ func (it *GojaIterator) IterFunc(i interface{}) error {
 	}
 
 	if it.hasDedupe {
-		value, err := it.VM.RunString("dedupe(i)")
+		value, err := it.call("dedupe", it.dedupeFunc, row)
 
 		if err != nil {
 			return err
@@ -260,75 +631,134 @@ func (it *GojaIterator) IterFunc(i interface{}) error {
 
 		if goja.IsUndefined(value) == false && goja.IsNull(value) == false {
 			var key string = value.String()
-			if _, found := it.dedupeMap[key]; found == true {
+			if it.dedupeMap.Seen(key) {
 				// We've seen this key before, skip.
+				it.stats.Add(Deduped)
 				return nil
-			} else {
-				it.dedupeMap[key] = true
 			}
 		}
 	}
 
 	if it.hasIterator {
-		value, err := it.VM.RunString("iter(i, accum)")
+		value, err := it.call("iter", it.iterFunc, row, it.accum())
 
 		if err != nil {
 			return err
 		}
 
 		if goja.IsUndefined(value) == false {
-			it.Emitter(value)
+			it.emit(value)
 		}
 	}
 
+	if it.window != nil {
+		return it.windowRow(row)
+	}
+
 	if it.hasAccumulator {
-		newAccum, err := it.VM.RunString("accumulator(i, accum)")
-		it.Accumulator = newAccum
+		newAccum, err := it.accumulate(row, it.accum())
 
 		if err != nil {
 			return err
 		}
+
+		it.Accumulator = newAccum
 	}
 
 	return nil
 }
 
 func (it *GojaIterator) FilterFunc(i interface{}) (bool, error) {
+	return it.filter(it.VM.ToValue(i))
+}
+
+func (it *GojaIterator) filter(row goja.Value) (bool, error) {
 	if it.hasFilter == false {
 		return true, nil
 	}
 
-	it.VM.Set("i", i)
-	it.VM.Set("accum", it.Accumulator)
-
-	value, err := it.VM.RunString("filter(i, accum)")
+	value, err := it.call("filter", it.filterFunc, row, it.accum())
 
 	if err != nil {
+		it.stats.Add(FilterError)
 		return false, err
 	}
 
-	return value.ToBoolean(), nil
+	if value.ToBoolean() {
+		it.stats.Add(FilterTrue)
+		return true, nil
+	}
+
+	it.stats.Add(FilterFalse)
+	return false, nil
+}
+
+// call runs the function of stage, timing it when stats are kept, and
+// wraps its error as a StageError.
+func (it *GojaIterator) call(stage string, fn goja.Callable, args ...goja.Value) (goja.Value, error) {
+	if it.stats == nil {
+		value, err := fn(goja.Undefined(), args...)
+		return value, atStage(stage, err)
+	}
+
+	start := time.Now()
+	value, err := fn(goja.Undefined(), args...)
+	it.stats.timed(stage, time.Since(start))
+	return value, atStage(stage, err)
+}
+
+func (it *GojaIterator) emit(value goja.Value) {
+	it.stats.Add(Emitted)
+	it.Emitter(value)
+}
+
+// accum returns the accumulator as a value that can be passed to a
+// stage function, null before pre has run.
+func (it *GojaIterator) accum() goja.Value {
+	if it.Accumulator == nil {
+		return goja.Null()
+	}
+	return it.Accumulator
 }
 
 func (it *GojaIterator) HandleChannel(input chan interface{}, failOnError bool) error {
-	var err error
-	err = it.PreIteration()
-	if err != nil && failOnError {
+	return it.HandleChannelBudget(input, failOnError, ErrorBudget{})
+}
+
+// HandleChannelBudget is HandleChannel that also stops with a
+// BudgetError once budget runs out.
+func (it *GojaIterator) HandleChannelBudget(input chan interface{}, failOnError bool, budget ErrorBudget) error {
+	counter := newErrorCounter(budget)
+
+	// handle returns the error that stops iteration, if any.
+	handle := func(err error) error {
+		if err == nil {
+			return nil
+		}
+		it.stats.Error(err)
+		if failOnError {
+			return err
+		}
+		return counter.failed(err)
+	}
+
+	err := handle(it.PreIteration())
+	if err != nil {
 		return err
 	}
 
 	for i := range input {
-		err = it.IterFunc(i)
-
-		if err != nil && failOnError {
+		counter.row()
+		err = handle(it.IterFunc(i))
+		if err != nil {
 			return err
 		}
-
 	}
-	err = it.PostIteration()
-	if err != nil && failOnError {
+
+	err = handle(it.PostIteration())
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return counter.done()
 }
@@ -0,0 +1,196 @@
+package jsl
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CSVWriter writes rows as delimited text. Nested objects and lists are
+// flattened into dotted column names ({"a": {"b": 1}} is column a.b) and
+// rows that are not objects are written to a single "value" column.
+//
+// Unless Columns is set the columns are the keys of the first row in
+// sorted order, keys of later rows that are not a column are dropped.
+// Columns is set from then on, even to no columns for a first row
+// without keys.
+type CSVWriter struct {
+	Columns []string
+
+	out       *csv.Writer
+	tsv       *bufio.Writer
+	hasHeader bool
+}
+
+// NewCSVWriter returns a writer for delimiter separated rows, a tab
+// delimiter writes TSV which has no quoting.
+func NewCSVWriter(w io.Writer, delimiter rune, columns []string) *CSVWriter {
+	if delimiter == '\t' {
+		return &CSVWriter{
+			Columns: columns,
+			tsv:     bufio.NewWriter(w),
+		}
+	}
+
+	out := csv.NewWriter(w)
+	out.Comma = delimiter
+
+	return &CSVWriter{
+		Columns: columns,
+		out:     out,
+	}
+}
+
+func (c *CSVWriter) WriteRecord(v interface{}) error {
+	row := make(map[string]string)
+	flattenRow(row, "", ExportValue(v))
+
+	if c.Columns == nil {
+		c.Columns = []string{}
+		for key := range row {
+			c.Columns = append(c.Columns, key)
+		}
+		sort.Strings(c.Columns)
+	}
+
+	if !c.hasHeader {
+		c.hasHeader = true
+		if err := c.writeRecord(c.Columns); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(c.Columns))
+	for n, column := range c.Columns {
+		record[n] = row[column]
+	}
+
+	return c.writeRecord(record)
+}
+
+// AppendOptions returns opts for appending csv or tsv rows to filename.
+// A file that already has rows has a header, so it is not written again
+// and unless opts has Columns they are read from that header. Options of
+// other formats are returned as they are.
+func AppendOptions(filename string, format string, opts WriteOptions) (WriteOptions, error) {
+	if format != "csv" && format != "tsv" {
+		return opts, nil
+	}
+
+	fh, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return opts, nil
+	}
+	if err != nil {
+		return opts, err
+	}
+	defer fh.Close()
+
+	r, err := Decompress(fh)
+	if err != nil {
+		return opts, err
+	}
+	defer r.Close()
+
+	header, err := bufio.NewReader(r).ReadString('\n')
+	if len(header) == 0 {
+		// An empty file gets a header like a new one.
+		if err == io.EOF {
+			err = nil
+		}
+		return opts, err
+	}
+
+	opts.NoHeader = true
+	if opts.Columns != nil {
+		return opts, nil
+	}
+
+	header = strings.TrimRight(header, "\r\n")
+	if len(header) == 0 {
+		opts.Columns = []string{}
+	} else if format == "tsv" {
+		opts.Columns = strings.Split(header, "\t")
+	} else if columns, err := csv.NewReader(strings.NewReader(header)).Read(); err == nil {
+		opts.Columns = columns
+	}
+	return opts, nil
+}
+
+// Flush writes any buffered rows to the underlying writer.
+func (c *CSVWriter) Flush() error {
+	if c.tsv != nil {
+		return c.tsv.Flush()
+	}
+
+	c.out.Flush()
+	return c.out.Error()
+}
+
+func (c *CSVWriter) writeRecord(record []string) error {
+	if c.tsv == nil {
+		return c.out.Write(record)
+	}
+
+	// TSV has no quoting, so tabs and line breaks can't be kept.
+	for n, field := range record {
+		record[n] = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, field)
+	}
+
+	_, err := c.tsv.WriteString(strings.Join(record, "\t") + "\n")
+	return err
+}
+
+// flattenRow stores the scalar values of v in row, keyed by their dotted
+// path below prefix.
+func flattenRow(row map[string]string, prefix string, v interface{}) {
+	join := func(key string) string {
+		if len(prefix) == 0 {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			flattenRow(row, join(key), value)
+		}
+	case []interface{}:
+		for n, value := range t {
+			flattenRow(row, join(strconv.Itoa(n)), value)
+		}
+	default:
+		if len(prefix) == 0 {
+			prefix = "value"
+		}
+		row[prefix] = formatField(v)
+	}
+}
+
+func formatField(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case fmt.Stringer:
+		return t.String()
+	}
+
+	if data, err := json.Marshal(v); err == nil {
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,98 @@
+package jsl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCSVWriter(t *testing.T) {
+	id, _ := new(big.Int).SetString("1311768467294899695", 10)
+
+	rows := []interface{}{
+		map[string]interface{}{
+			"name": "smith, bob",
+			"age":  int64(31),
+			"tags": []interface{}{"a", "b"},
+			"addr": map[string]interface{}{"city": "Paris", "zip": nil},
+		},
+		map[string]interface{}{"name": "ann \"the\" great", "age": 2.5, "id": id, "tags": []interface{}{}},
+	}
+
+	var output bytes.Buffer
+	writer := NewCSVWriter(&output, ',', nil)
+	for _, row := range rows {
+		if err := writer.WriteRecord(row); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+	writer.Flush()
+
+	expected := "addr.city,addr.zip,age,name,tags.0,tags.1\n" +
+		"Paris,,31,\"smith, bob\",a,b\n" +
+		",,2.5,\"ann \"\"the\"\" great\",,\n"
+
+	if output.String() != expected {
+		t.Errorf("Incorrect csv output:\n%s", output.String())
+	}
+
+	output.Reset()
+	writer = NewCSVWriter(&output, '\t', []string{"id", "name", "missing"})
+	for _, row := range rows {
+		writer.WriteRecord(row)
+	}
+	writer.WriteRecord("a\tscalar")
+	writer.Flush()
+
+	expected = "id\tname\tmissing\n" +
+		"\tsmith, bob\t\n" +
+		"1311768467294899695\tann \"the\" great\t\n" +
+		"\t\t\n"
+
+	if output.String() != expected {
+		t.Errorf("Incorrect tsv output:\n%q", output.String())
+	}
+
+	// The first row sets the columns, even to none.
+	output.Reset()
+	writer = NewCSVWriter(&output, ',', nil)
+	writer.WriteRecord(map[string]interface{}{})
+	writer.WriteRecord(map[string]interface{}{"a": 1})
+	writer.Flush()
+
+	if output.String() != "\n\n\n" {
+		t.Errorf("Incorrect output after an empty first row:\n%q", output.String())
+	}
+}
+
+func TestAppendOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsl-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "out.csv")
+	opts, err := AppendOptions(filename, "csv", WriteOptions{})
+	if err != nil || opts.NoHeader || opts.Columns != nil {
+		t.Errorf("A missing file should get a header: %+v %v", opts, err)
+	}
+
+	ioutil.WriteFile(filename, []byte("b,\"a, c\"\n1,2\n"), 0644)
+	opts, err = AppendOptions(filename, "csv", WriteOptions{})
+	if err != nil || !opts.NoHeader || !reflect.DeepEqual(opts.Columns, []string{"b", "a, c"}) {
+		t.Errorf("Expected the columns of the header without writing it: %+v %v", opts, err)
+	}
+
+	opts, _ = AppendOptions(filename, "csv", WriteOptions{Columns: []string{"x"}})
+	if !opts.NoHeader || !reflect.DeepEqual(opts.Columns, []string{"x"}) {
+		t.Errorf("Columns that are set should be kept: %+v", opts)
+	}
+
+	opts, _ = AppendOptions(filename, "json", WriteOptions{})
+	if opts.NoHeader {
+		t.Errorf("Only csv and tsv have headers: %+v", opts)
+	}
+}
@@ -0,0 +1,307 @@
+package jsl
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Record is a single row of input tagged with its position in the
+// input stream, Seq starts at 0 and increases by one for every row.
+//
+// File and Line locate the row in its input, Line is the line number
+// for line based formats and the item number for nested documents.
+type Record struct {
+	Seq   uint64
+	File  string
+	Line  int
+	Value interface{}
+}
+
+// Emission holds every value emitted while handling the record with
+// the same Seq, it is empty when the row was filtered or failed.
+type Emission struct {
+	Seq    uint64
+	Values []interface{}
+}
+
+// ParallelConfig controls how HandleParallel spreads rows over workers.
+type ParallelConfig struct {
+	Workers     int
+	FailOnError bool
+
+	// Budget stops iteration with a BudgetError after too many errors,
+	// when FailOnError is not set.
+	Budget ErrorBudget
+
+	// Ordered emits rows in input order instead of as soon as a worker
+	// is done with them. At most ReorderSize rows are in flight while
+	// waiting on a slow worker.
+	Ordered     bool
+	ReorderSize int
+
+	// EmitEvery runs post on the accumulator so far at this interval,
+	// for following growing input. It needs a single worker.
+	EmitEvery time.Duration
+
+	// Export turns the values emitted by a worker into the values given
+	// to the Emitter of the IterConfig with Ordered, where rows are
+	// emitted from another goroutine and a goja.Runtime is not safe to
+	// share between goroutines. It runs on the worker and is ExportValue
+	// when nil.
+	Export func(interface{}) interface{}
+
+	// OnError is called with every error, from any worker. Errors are
+	// logged when it is not set.
+	OnError func(error)
+
+	// Errors handles the errors of the run, it is made from FailOnError,
+	// Budget and OnError when nil. Set it to report errors found outside
+	// the workers too, like results that can't be written.
+	Errors *ErrorHandler
+}
+
+const DEFAULT_REORDER_SIZE = 1024
+
+// Sequence numbers rows read from in and forwards them to out, closing
+// out once in is closed.
+func Sequence(in chan Record, out chan Record) {
+	defer close(out)
+
+	var seq uint64
+	for rec := range in {
+		rec.Seq = seq
+		out <- rec
+		seq += 1
+	}
+}
+
+// HandleParallel is the multi worker version of HandleChannel. Each
+// worker owns an iterator (and VM) and pulls rows from the shared input
+// channel, so every worker sees a shard of the input. Once the input is
+// exhausted the worker accumulators are combined with merge(a, b) and
+// post is run a single time on the result.
+//
+// Unless pc.Ordered is set rows are emitted by whichever worker handled
+// them, so the order of emitted rows is not preserved.
+func HandleParallel(ic *IterConfig, pc ParallelConfig, input chan Record) error {
+	workers := pc.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	if pc.EmitEvery > 0 && workers > 1 {
+		return errors.New("emit every needs a single worker")
+	}
+
+	if ic.Window.Enabled() && workers > 1 {
+		return errors.New("windows need a single worker")
+	}
+
+	// Iterators are created up front, NewIterator fills in defaults on
+	// the shared config.
+	iters := make([]*GojaIterator, workers)
+	for n := range iters {
+		iter, err := NewIterator(ic)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			// Dedupe keys are global, not per shard.
+			iter.dedupeMap = iters[0].dedupeMap
+		}
+
+		iters[n] = iter
+	}
+
+	errs := pc.Errors
+	if errs == nil {
+		errs = NewErrorHandler(pc, ic.Stats)
+	}
+	quit := errs.quit
+	handle := errs.Handle
+
+	work := input
+	var emissions chan Emission
+	var collected chan bool
+
+	if pc.Ordered {
+		size := pc.ReorderSize
+		if size < 1 {
+			size = DEFAULT_REORDER_SIZE
+		}
+
+		// Every row holds a slot in window until it has been emitted,
+		// which bounds the rows waiting in the reorder buffer.
+		window := make(chan bool, size)
+		work = make(chan Record)
+		emissions = make(chan Emission, workers)
+		collected = make(chan bool)
+
+		go feedWindow(input, work, window, quit)
+		go func() {
+			reorderEmissions(emissions, window, ic.Emitter)
+			close(collected)
+		}()
+	}
+
+	wg := sync.WaitGroup{}
+
+	for _, iter := range iters {
+		wg.Add(1)
+		go func(iter *GojaIterator) {
+			defer wg.Done()
+
+			export := pc.Export
+			if export == nil {
+				export = ExportValue
+			}
+
+			var batch []interface{}
+			if pc.Ordered {
+				// Batches are emitted from the reorder goroutine, values
+				// leave the VM of this worker first.
+				iter.Emitter = func(i interface{}) {
+					batch = append(batch, export(i))
+				}
+			}
+
+			err := iter.PreIteration()
+			if err != nil && !handle(err) {
+				return
+			}
+
+			var tick <-chan time.Time
+			if pc.EmitEvery > 0 {
+				ticker := time.NewTicker(pc.EmitEvery)
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+
+			var windowTick <-chan time.Time
+			if ic.Window.WallClock() {
+				ticker := time.NewTicker(ic.Window.TickInterval())
+				defer ticker.Stop()
+				windowTick = ticker.C
+			}
+
+			// emitNow runs a step that is not tied to a row, its values
+			// are emitted as soon as possible. It returns false when
+			// the worker should stop.
+			emitNow := func(step func() error) bool {
+				batch = nil
+				err := step()
+				if err != nil && !handle(err) {
+					return false
+				}
+
+				for _, v := range batch {
+					ic.Emitter(v)
+				}
+				return true
+			}
+
+			for {
+				select {
+				case <-quit:
+					return
+				case <-tick:
+					if !emitNow(iter.EmitAccumulator) {
+						return
+					}
+				case now := <-windowTick:
+					if !emitNow(func() error { return iter.WindowTick(now) }) {
+						return
+					}
+				case rec, ok := <-work:
+					if !ok {
+						return
+					}
+
+					batch = nil
+					errs.row()
+					err := iter.IterRecord(rec)
+					if err != nil && !handle(err) {
+						return
+					}
+
+					if pc.Ordered {
+						emissions <- Emission{Seq: rec.Seq, Values: batch}
+					}
+				}
+			}
+		}(iter)
+	}
+
+	wg.Wait()
+
+	if pc.Ordered {
+		close(emissions)
+		<-collected
+		iters[0].Emitter = ic.Emitter
+	}
+
+	if err := errs.stopped(); err != nil {
+		return err
+	}
+
+	for _, other := range iters[1:] {
+		err := iters[0].Merge(other)
+		if err != nil && !handle(err) {
+			return errs.stopped()
+		}
+	}
+
+	err := iters[0].PostIteration()
+	if err != nil && !handle(err) {
+		return errs.stopped()
+	}
+
+	return errs.Err()
+}
+
+// feedWindow forwards records to work, taking a slot in window for each.
+func feedWindow(input chan Record, work chan Record, window chan bool, quit chan bool) {
+	defer close(work)
+
+	for rec := range input {
+		select {
+		case window <- true:
+		case <-quit:
+			return
+		}
+
+		select {
+		case work <- rec:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// reorderEmissions holds back emissions until every earlier row has been
+// emitted, then passes their values to emit in input order.
+func reorderEmissions(emissions chan Emission, window chan bool, emit func(interface{})) {
+	pending := make(map[uint64][]interface{})
+	var next uint64
+
+	for e := range emissions {
+		pending[e.Seq] = e.Values
+
+		for {
+			values, found := pending[next]
+			if !found {
+				break
+			}
+			delete(pending, next)
+
+			for _, v := range values {
+				emit(v)
+			}
+
+			next += 1
+			<-window
+		}
+	}
+}
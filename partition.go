@@ -0,0 +1,264 @@
+package jsl
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+const DEFAULT_PARTITION_MAX_OPEN = 64
+
+// PartitionConfig describes how a PartitionWriter splits its output.
+type PartitionConfig struct {
+	// Expression is run on every value (as i), the result is the key of
+	// the partition the value is written to.
+	Expression string
+
+	// Path is the filename of each partition, {key} is replaced by the
+	// key. Compression is inferred from the extension unless set.
+	Path        string
+	Compression string
+
+	Format  string
+	Options WriteOptions
+
+	// At most MaxOpen files are kept open, the least recently written
+	// is closed to make room and reopened for appending when needed.
+	MaxOpen int
+
+	// Append adds to existing files instead of replacing them.
+	Append bool
+}
+
+// PartitionWriter is a RecordWriter that routes every value to a file
+// named from the result of a javascript expression.
+type PartitionWriter struct {
+	config    PartitionConfig
+	vm        *goja.Runtime
+	keyFunc   goja.Callable
+	open      map[string]*list.Element
+	recent    *list.List
+	writtenTo map[string]bool
+
+	// columns of the csv and tsv partitions that were closed, they are
+	// kept when reopened to match the header.
+	columns map[string][]string
+}
+
+type partitionFile struct {
+	key        string
+	file       *os.File
+	compressor io.WriteCloser
+	writer     RecordWriter
+}
+
+func NewPartitionWriter(config PartitionConfig) (*PartitionWriter, error) {
+	if !strings.Contains(config.Path, "{key}") {
+		return nil, errors.New("partition path must contain {key}")
+	}
+
+	if config.MaxOpen < 1 {
+		config.MaxOpen = DEFAULT_PARTITION_MAX_OPEN
+	}
+
+	if len(config.Compression) == 0 {
+		config.Compression = CompressionFromFilename(config.Path)
+	}
+
+	// Fail early on an unknown format or compression.
+	if _, err := NewWriter(config.Format, io.Discard, config.Options); err != nil {
+		return nil, err
+	}
+	if _, err := Compress(io.Discard, config.Compression); err != nil {
+		return nil, err
+	}
+
+	prefix, suffix := "function partition(i) { return ", " }"
+	if err := checkStage("partition", prefix, config.Expression, suffix); err != nil {
+		return nil, err
+	}
+
+	vm := goja.New()
+	_, err := vm.RunString(prefix + config.Expression + suffix)
+	if err != nil {
+		return nil, &ScriptError{Stage: "partition", Code: config.Expression, Message: err.Error()}
+	}
+
+	keyFunc, ok := goja.AssertFunction(vm.Get("partition"))
+	if !ok {
+		return nil, errors.New("partition expression is not valid")
+	}
+
+	return &PartitionWriter{
+		config:    config,
+		vm:        vm,
+		keyFunc:   keyFunc,
+		open:      make(map[string]*list.Element),
+		recent:    list.New(),
+		writtenTo: make(map[string]bool),
+		columns:   make(map[string][]string),
+	}, nil
+}
+
+// Key returns the partition key of v.
+func (p *PartitionWriter) Key(v interface{}) (string, error) {
+	value, err := p.keyFunc(goja.Undefined(), p.vm.ToValue(ExportValue(v)))
+	if err != nil {
+		return "", atStage("partition", err)
+	}
+
+	return sanitizeKey(value.String()), nil
+}
+
+// sanitizeKey keeps keys from escaping the partition directory.
+func sanitizeKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator || r == 0 {
+			return '_'
+		}
+		return r
+	}, key)
+
+	if key == "" || key == "." || key == ".." {
+		return "_" + key
+	}
+	return key
+}
+
+func (p *PartitionWriter) WriteRecord(v interface{}) error {
+	key, err := p.Key(v)
+	if err != nil {
+		return err
+	}
+
+	pf, err := p.file(key)
+	if err != nil {
+		return err
+	}
+
+	return pf.writer.WriteRecord(v)
+}
+
+// file returns the open partition for key, opening it when needed.
+func (p *PartitionWriter) file(key string) (*partitionFile, error) {
+	if element, found := p.open[key]; found {
+		p.recent.MoveToFront(element)
+		return element.Value.(*partitionFile), nil
+	}
+
+	if p.recent.Len() >= p.config.MaxOpen {
+		oldest := p.recent.Back()
+		p.recent.Remove(oldest)
+		delete(p.open, oldest.Value.(*partitionFile).key)
+
+		if csvWriter, ok := oldest.Value.(*partitionFile).writer.(*CSVWriter); ok {
+			p.columns[oldest.Value.(*partitionFile).key] = csvWriter.Columns
+		}
+
+		if err := oldest.Value.(*partitionFile).close(); err != nil {
+			return nil, err
+		}
+	}
+
+	filename := strings.Replace(p.config.Path, "{key}", key, -1)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	reopen := p.writtenTo[key]
+
+	options := p.config.Options
+	if reopen {
+		options.NoHeader = true
+		options.Columns = p.columns[key]
+	} else if p.config.Append {
+		appendOptions, err := AppendOptions(filename, p.config.Format, options)
+		if err != nil {
+			return nil, err
+		}
+		options = appendOptions
+	}
+
+	file_mode := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if p.config.Append || reopen {
+		file_mode = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	}
+
+	fh, err := os.OpenFile(filename, file_mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := Compress(fh, p.config.Compression)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	writer, err := NewWriter(p.config.Format, compressor, options)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	pf := &partitionFile{
+		key:        key,
+		file:       fh,
+		compressor: compressor,
+		writer:     writer,
+	}
+
+	p.writtenTo[key] = true
+	p.open[key] = p.recent.PushFront(pf)
+
+	return pf, nil
+}
+
+func (pf *partitionFile) close() error {
+	if err := pf.writer.Flush(); err != nil {
+		pf.file.Close()
+		return err
+	}
+
+	if err := pf.compressor.Close(); err != nil {
+		pf.file.Close()
+		return err
+	}
+
+	return pf.file.Close()
+}
+
+// Flush flushes the writers and compressors of every open partition.
+func (p *PartitionWriter) Flush() error {
+	for element := p.recent.Front(); element != nil; element = element.Next() {
+		pf := element.Value.(*partitionFile)
+		if err := pf.writer.Flush(); err != nil {
+			return err
+		}
+		if err := FlushCompressed(pf.compressor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes every open partition.
+func (p *PartitionWriter) Close() error {
+	var firstErr error
+
+	for element := p.recent.Front(); element != nil; element = element.Next() {
+		if err := element.Value.(*partitionFile).close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	p.open = make(map[string]*list.Element)
+	p.recent.Init()
+
+	return firstErr
+}
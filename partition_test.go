@@ -0,0 +1,133 @@
+package jsl
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitionWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsl-partition")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewPartitionWriter(PartitionConfig{
+		Expression: "i.kind",
+		Path:       filepath.Join(dir, "{key}", "out.csv"),
+		Format:     "csv",
+		MaxOpen:    1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+
+	rows := []map[string]interface{}{
+		{"kind": "a", "n": 1},
+		{"kind": "b", "n": 2},
+		{"kind": "a", "n": 3, "extra": true},
+		{"kind": "../up", "n": 4},
+	}
+
+	for _, row := range rows {
+		if err := writer.WriteRecord(row); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	// Appending to an existing partition keeps its header and columns.
+	writer, err = NewPartitionWriter(PartitionConfig{
+		Expression: "i.kind",
+		Path:       filepath.Join(dir, "{key}", "out.csv"),
+		Format:     "csv",
+		Append:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	writer.WriteRecord(map[string]interface{}{"n": 5, "kind": "a", "extra": true})
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	expected := map[string]string{
+		"a":     "kind,n\na,1\na,3\na,5\n",
+		"b":     "kind,n\nb,2\n",
+		".._up": "kind,n\n../up,4\n",
+	}
+
+	for key, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key, "out.csv"))
+		if err != nil {
+			t.Errorf("Partition %s missing: %s", key, err)
+			continue
+		}
+
+		if string(data) != content {
+			t.Errorf("Partition %s is %q, expected %q", key, data, content)
+		}
+	}
+}
+
+func TestPartitionWriter_Flush(t *testing.T) {
+	dir := t.TempDir()
+
+	writer, err := NewPartitionWriter(PartitionConfig{
+		Expression:  "i.kind",
+		Path:        filepath.Join(dir, "{key}.json.gz"),
+		Compression: "gzip",
+		Format:      "json",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %s", err)
+	}
+	defer writer.Close()
+
+	writer.WriteRecord(map[string]interface{}{"kind": "a"})
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	// The partition is still open, its gzip stream is not finished.
+	fh, _ := os.Open(filepath.Join(dir, "a.json.gz"))
+	defer fh.Close()
+
+	r, err := Decompress(fh)
+	if err != nil {
+		t.Fatalf("Failed to read partition: %s", err)
+	}
+	data, _ := io.ReadAll(r)
+	if string(data) != "{\"kind\":\"a\"}\n" {
+		t.Errorf("Flushed partition is %q", data)
+	}
+}
+
+func TestPartitionWriter_Path(t *testing.T) {
+	_, err := NewPartitionWriter(PartitionConfig{
+		Expression: "i.kind",
+		Path:       "out.json",
+		Format:     "json",
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a path without {key}.")
+	}
+}
+
+func TestPartitionWriter_ScriptError(t *testing.T) {
+	_, err := NewPartitionWriter(PartitionConfig{
+		Expression: "i.kind +",
+		Path:       "{key}.json",
+		Format:     "json",
+	})
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok || scriptErr.Stage != "partition" || scriptErr.Line != 1 || scriptErr.Column != 9 {
+		t.Errorf("Expected a ScriptError at partition:1:9, got %v", err)
+	}
+}
@@ -0,0 +1,459 @@
+package jsl
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/dop251/goja"
+)
+
+// Sketches are aggregates that use a fixed amount of memory however many
+// values are added, at the cost of an approximate value. Values are
+// compared as strings, like topk.
+
+const (
+	DEFAULT_HLL_PRECISION       = 14
+	DEFAULT_COUNTMIN_WIDTH      = 2048
+	DEFAULT_COUNTMIN_DEPTH      = 5
+	DEFAULT_TDIGEST_COMPRESSION = 100
+)
+
+// sketchHash is 64 bit FNV-1a with a splitmix64 finisher, FNV alone
+// does not spread short keys well enough for the sketches.
+func sketchHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for n := 0; n < len(key); n += 1 {
+		h ^= uint64(key[n])
+		h *= 1099511628211
+	}
+
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// sketchArg returns args[n] as a positive integer, or def when missing.
+func sketchArg(args []goja.Value, n int, name string, def int) (int, error) {
+	if len(args) <= n {
+		return def, nil
+	}
+
+	f, ok := aggregateNumber(args[n])
+	if !ok || f < 1 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s %s is not a positive integer", name, args[n])
+	}
+	return int(f), nil
+}
+
+// hllAggregate is a HyperLogLog estimating the number of distinct
+// values, 2^precision registers give a standard error of about
+// 1.04/sqrt(2^precision), 0.8% for the default of 14 (16KB).
+type hllAggregate struct {
+	precision uint
+	registers []uint8
+}
+
+func newHLLAggregate(args []goja.Value) (Aggregate, error) {
+	precision, err := sketchArg(args, 0, "precision", DEFAULT_HLL_PRECISION)
+	if err != nil {
+		return nil, err
+	}
+	if precision < 4 || precision > 18 {
+		return nil, fmt.Errorf("precision %d is not between 4 and 18", precision)
+	}
+
+	return &hllAggregate{
+		precision: uint(precision),
+		registers: make([]uint8, 1<<uint(precision)),
+	}, nil
+}
+
+func (a *hllAggregate) Add(x goja.Value) {
+	if x == nil || goja.IsUndefined(x) || goja.IsNull(x) {
+		return
+	}
+
+	h := sketchHash(x.String())
+	index := h >> (64 - a.precision)
+	rank := uint8(bits.LeadingZeros64(h<<a.precision|1<<(a.precision-1)) + 1)
+
+	if rank > a.registers[index] {
+		a.registers[index] = rank
+	}
+}
+
+func (a *hllAggregate) Value() interface{} {
+	m := float64(len(a.registers))
+
+	var sum float64
+	var zeros int
+	for _, r := range a.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros += 1
+		}
+	}
+
+	var alpha float64
+	switch len(a.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(estimate + 0.5)
+}
+
+func (a *hllAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*hllAggregate)
+	if !ok || a.precision != b.precision {
+		return mergeMismatch(a, other)
+	}
+
+	for n, r := range b.registers {
+		if r > a.registers[n] {
+			a.registers[n] = r
+		}
+	}
+	return nil
+}
+
+func (a *hllAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *hllAggregate) String() string               { return formatAggregate(a) }
+
+// countMinAggregate is a Count-Min sketch estimating how often values
+// were added, estimates are never too low. Its value is the k values
+// with the highest estimates as [{key, count}].
+type countMinAggregate struct {
+	k      int
+	width  uint64
+	counts [][]int64
+	total  int64
+
+	// top holds the k values with the highest estimates seen so far.
+	top map[string]int64
+}
+
+func newCountMinAggregate(args []goja.Value) (Aggregate, error) {
+	k, err := sketchArg(args, 0, "k", 10)
+	if err != nil {
+		return nil, err
+	}
+	width, err := sketchArg(args, 1, "width", DEFAULT_COUNTMIN_WIDTH)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := sketchArg(args, 2, "depth", DEFAULT_COUNTMIN_DEPTH)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &countMinAggregate{
+		k:      k,
+		width:  uint64(width),
+		counts: make([][]int64, depth),
+		top:    make(map[string]int64),
+	}
+	for n := range a.counts {
+		a.counts[n] = make([]int64, width)
+	}
+	return a, nil
+}
+
+// index is the column of row n for the hash h, the rows use double
+// hashing from the two halves of h.
+func (a *countMinAggregate) index(h uint64, n int) uint64 {
+	return ((h >> 32) + uint64(n)*(h&0xffffffff|1)) % a.width
+}
+
+func (a *countMinAggregate) Add(x goja.Value) {
+	if x == nil || goja.IsUndefined(x) || goja.IsNull(x) {
+		return
+	}
+
+	key := x.String()
+	h := sketchHash(key)
+	for n, row := range a.counts {
+		row[a.index(h, n)] += 1
+	}
+	a.total += 1
+
+	a.offer(key, a.estimate(h))
+}
+
+// offer keeps key in top when its estimate is among the k highest.
+func (a *countMinAggregate) offer(key string, estimate int64) {
+	if _, found := a.top[key]; found || len(a.top) < a.k {
+		a.top[key] = estimate
+		return
+	}
+
+	var lowest string
+	var lowestCount int64 = math.MaxInt64
+	for candidate, count := range a.top {
+		if count < lowestCount || (count == lowestCount && candidate > lowest) {
+			lowest, lowestCount = candidate, count
+		}
+	}
+
+	if estimate > lowestCount {
+		delete(a.top, lowest)
+		a.top[key] = estimate
+	}
+}
+
+func (a *countMinAggregate) estimate(h uint64) int64 {
+	var lowest int64 = math.MaxInt64
+	for n, row := range a.counts {
+		if count := row[a.index(h, n)]; count < lowest {
+			lowest = count
+		}
+	}
+	return lowest
+}
+
+// Estimate returns how often x was added, never less than the real count.
+func (a *countMinAggregate) Estimate(x goja.Value) int64 {
+	return a.estimate(sketchHash(x.String()))
+}
+
+// Total returns the number of values added.
+func (a *countMinAggregate) Total() int64 {
+	return a.total
+}
+
+func (a *countMinAggregate) Value() interface{} {
+	keys := make([]string, 0, len(a.top))
+	for key := range a.top {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if a.top[keys[i]] != a.top[keys[j]] {
+			return a.top[keys[i]] > a.top[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	result := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, map[string]interface{}{"key": key, "count": a.top[key]})
+	}
+	return result
+}
+
+func (a *countMinAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*countMinAggregate)
+	if !ok || a.width != b.width || len(a.counts) != len(b.counts) {
+		return mergeMismatch(a, other)
+	}
+
+	for n, row := range b.counts {
+		for m, count := range row {
+			a.counts[n][m] += count
+		}
+	}
+	a.total += b.total
+
+	// Estimates of both candidate lists are redone on the merged table.
+	candidates := make([]string, 0, len(a.top)+len(b.top))
+	for key := range a.top {
+		candidates = append(candidates, key)
+	}
+	for key := range b.top {
+		candidates = append(candidates, key)
+	}
+
+	a.top = make(map[string]int64)
+	for _, key := range candidates {
+		a.offer(key, a.estimate(sketchHash(key)))
+	}
+	return nil
+}
+
+func (a *countMinAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *countMinAggregate) String() string               { return formatAggregate(a) }
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigestAggregate is a merging t-digest estimating percentiles, it is
+// most accurate near the ends (p1, p99.9) and keeps a few hundred
+// centroids however many values are added. Its value is like the value
+// of percentile.
+type tdigestAggregate struct {
+	percents    []float64
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	min         float64
+	max         float64
+}
+
+func newTDigestAggregate(args []goja.Value) (Aggregate, error) {
+	percentiles, err := newPercentileAggregate(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tdigestAggregate{
+		percents:    percentiles.(*percentileAggregate).percents,
+		compression: DEFAULT_TDIGEST_COMPRESSION,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}, nil
+}
+
+func (a *tdigestAggregate) Add(x goja.Value) {
+	f, ok := aggregateNumber(x)
+	if !ok {
+		return
+	}
+
+	a.add(centroid{mean: f, weight: 1})
+	a.min = math.Min(a.min, f)
+	a.max = math.Max(a.max, f)
+}
+
+func (a *tdigestAggregate) add(c centroid) {
+	a.buffer = append(a.buffer, c)
+	if len(a.buffer) >= int(5*a.compression) {
+		a.compress()
+	}
+}
+
+// compress merges the buffer into the centroids, neighbouring centroids
+// are combined while their weight stays under 4*n*q*(1-q)/compression.
+func (a *tdigestAggregate) compress() {
+	if len(a.buffer) == 0 {
+		return
+	}
+
+	all := append(a.centroids, a.buffer...)
+	a.buffer = a.buffer[:0]
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mean < all[j].mean
+	})
+
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+
+	merged := make([]centroid, 0, len(all))
+	current := all[0]
+	var before float64
+
+	for _, c := range all[1:] {
+		q0 := before / total
+		q2 := (before + current.weight + c.weight) / total
+		limit := 4 * total * math.Min(q0*(1-q0), q2*(1-q2)) / a.compression
+
+		if current.weight+c.weight <= limit {
+			weight := current.weight + c.weight
+			current.mean += (c.mean - current.mean) * c.weight / weight
+			current.weight = weight
+		} else {
+			merged = append(merged, current)
+			before += current.weight
+			current = c
+		}
+	}
+
+	a.centroids = append(merged, current)
+}
+
+// Percentile returns the estimated value at percentile p, null when
+// nothing was added.
+func (a *tdigestAggregate) Percentile(p float64) interface{} {
+	a.compress()
+
+	if len(a.centroids) == 0 {
+		return nil
+	}
+	if p <= 0 {
+		return a.min
+	}
+	if p >= 100 {
+		return a.max
+	}
+	if len(a.centroids) == 1 {
+		return a.centroids[0].mean
+	}
+
+	var total float64
+	for _, c := range a.centroids {
+		total += c.weight
+	}
+
+	// Centroid means sit in the middle of their weight, between them
+	// values are interpolated and beyond them up to the min and max.
+	target := p / 100 * total
+	prevMean, prevAt := a.min, 0.0
+
+	var at float64
+	for _, c := range a.centroids {
+		center := at + c.weight/2
+		if target < center {
+			return prevMean + (c.mean-prevMean)*(target-prevAt)/(center-prevAt)
+		}
+		prevMean, prevAt = c.mean, center
+		at += c.weight
+	}
+
+	if total == prevAt {
+		return a.max
+	}
+	return prevMean + (a.max-prevMean)*(target-prevAt)/(total-prevAt)
+}
+
+func (a *tdigestAggregate) Value() interface{} {
+	if len(a.percents) == 1 {
+		return a.Percentile(a.percents[0])
+	}
+
+	result := make(map[string]interface{}, len(a.percents))
+	for _, p := range a.percents {
+		result["p"+strconv.FormatFloat(p, 'f', -1, 64)] = a.Percentile(p)
+	}
+	return result
+}
+
+func (a *tdigestAggregate) Merge(other Aggregate) error {
+	b, ok := other.(*tdigestAggregate)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+
+	b.compress()
+	for _, c := range b.centroids {
+		a.add(c)
+	}
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+	return nil
+}
+
+func (a *tdigestAggregate) MarshalJSON() ([]byte, error) { return marshalAggregate(a) }
+func (a *tdigestAggregate) String() string               { return formatAggregate(a) }
@@ -0,0 +1,142 @@
+package jsl
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestHLL(t *testing.T) {
+	vm := goja.New()
+
+	for _, distinct := range []int{10, 1000, 200000} {
+		a, _ := newHLLAggregate(nil)
+		b, _ := newHLLAggregate(nil)
+
+		for n := 0; n < distinct; n += 1 {
+			// Every value twice, half of them in each sketch.
+			key := vm.ToValue(fmt.Sprintf("user-%d", n))
+			a.Add(key)
+			if n%2 == 0 {
+				a.Add(key)
+			} else {
+				b.Add(key)
+			}
+		}
+
+		if err := a.Merge(b); err != nil {
+			t.Fatalf("Merge failed: %s", err)
+		}
+
+		estimate := a.Value().(int64)
+		if math.Abs(float64(estimate-int64(distinct))) > 0.02*float64(distinct) {
+			t.Errorf("Distinct %d estimated as %d", distinct, estimate)
+		}
+	}
+
+	small, _ := newHLLAggregate([]goja.Value{vm.ToValue(10)})
+	if err := small.Merge(&hllAggregate{precision: 14}); err == nil {
+		t.Errorf("Expected an error merging different precisions.")
+	}
+}
+
+func TestCountMin(t *testing.T) {
+	vm := goja.New()
+
+	a, _ := newCountMinAggregate([]goja.Value{vm.ToValue(3), vm.ToValue(256), vm.ToValue(4)})
+	b, _ := newCountMinAggregate([]goja.Value{vm.ToValue(3), vm.ToValue(256), vm.ToValue(4)})
+
+	// hot-0 is added 1000 times, hot-1 500 and hot-2 250, along with
+	// 5000 values seen once.
+	for n := 0; n < 5000; n += 1 {
+		a.Add(vm.ToValue(fmt.Sprintf("cold-%d", n)))
+		for hot := 0; hot < 3; hot += 1 {
+			if n%(5<<uint(hot)) == 0 {
+				b.Add(vm.ToValue(fmt.Sprintf("hot-%d", hot)))
+			}
+		}
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+
+	top := a.Value().([]interface{})
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 values, got %v", top)
+	}
+
+	for n, entry := range top {
+		entry := entry.(map[string]interface{})
+		if entry["key"] != fmt.Sprintf("hot-%d", n) || entry["count"].(int64) < int64(1000>>uint(n)) {
+			t.Errorf("Top %d incorrect: %v", n, top)
+		}
+	}
+
+	cm := a.(*countMinAggregate)
+	if cm.Total() != 6750 || cm.Estimate(vm.ToValue("hot-0")) < 1000 {
+		t.Errorf("Total %d or estimate %d incorrect", cm.Total(), cm.Estimate(vm.ToValue("hot-0")))
+	}
+}
+
+func TestTDigest(t *testing.T) {
+	vm := goja.New()
+
+	a, _ := newTDigestAggregate([]goja.Value{vm.ToValue(1), vm.ToValue(50), vm.ToValue(99), vm.ToValue(99.9)})
+	b, _ := newTDigestAggregate([]goja.Value{vm.ToValue(50)})
+
+	// 1 to 100000 shuffled over the two digests.
+	for n := 1; n <= 100000; n += 1 {
+		v := vm.ToValue((n*7919)%100000 + 1)
+		if n%3 == 0 {
+			b.Add(v)
+		} else {
+			a.Add(v)
+		}
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+
+	result := a.Value().(map[string]interface{})
+	expected := map[string]float64{"p1": 1000, "p50": 50000, "p99": 99000, "p99.9": 99900}
+
+	for key, value := range expected {
+		estimate := result[key].(float64)
+		if math.Abs(estimate-value) > 0.005*100000 {
+			t.Errorf("%s estimated as %f, expected %f", key, estimate, value)
+		}
+	}
+
+	td := a.(*tdigestAggregate)
+	if td.Percentile(0) != float64(1) || td.Percentile(100) != float64(100000) {
+		t.Errorf("Ends incorrect: %v %v", td.Percentile(0), td.Percentile(100))
+	}
+
+	if len(td.centroids) > 1000 {
+		t.Errorf("Too many centroids: %d", len(td.centroids))
+	}
+}
+
+func TestSketches_Iterator(t *testing.T) {
+	iter, _ := NewIterator(&IterConfig{})
+
+	value, err := iter.RunString(`
+		var s = {users: hll(), pages: countmin(1), ms: tdigest(50)};
+		for (var n = 0; n < 100; n += 1) {
+			s.users.add("u" + (n % 40));
+			s.pages.add(n % 3 == 0 ? "/" : "/p" + n);
+			s.ms.add(n);
+		}
+		JSON.stringify(s) + " " + s.pages.estimate("/") + " " + s.ms.percentile(0)`)
+	if err != nil {
+		t.Fatalf("Sketches failed: %s", err)
+	}
+
+	if value.String() != `{"users":40,"pages":[{"count":34,"key":"/"}],"ms":49.5} 34 0` {
+		t.Errorf("Sketches incorrect: %s", value)
+	}
+}
@@ -0,0 +1,150 @@
+package jsl
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stageNames are the stages stats are kept for, in the order they run.
+var stageNames = [...]string{"pre", "filter", "dedupe", "iter", "group", "accum", "window", "merge", "post", "partition", "output"}
+
+var statNames = map[StatType]string{
+	IterOk:      "ok",
+	IterError:   "failed",
+	FilterTrue:  "kept",
+	FilterFalse: "filtered",
+	FilterError: "filter_errors",
+	RowsRead:    "rows",
+	ParseError:  "parse_errors",
+	Deduped:     "deduped",
+	Emitted:     "emitted",
+}
+
+// Stats counts what happened to the rows of a run and how long each
+// stage took. It is shared by the reader and every worker, a nil *Stats
+// keeps nothing.
+type Stats struct {
+	start  time.Time
+	counts [statTypes]int64
+
+	stageCalls  [len(stageNames)]int64
+	stageErrors [len(stageNames)]int64
+	stageTime   [len(stageNames)]int64
+}
+
+func NewStats() *Stats {
+	return &Stats{start: time.Now()}
+}
+
+// Add counts one occurrence of stat.
+func (s *Stats) Add(stat StatType) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.counts[stat], 1)
+}
+
+func (s *Stats) Count(stat StatType) int64 {
+	return atomic.LoadInt64(&s.counts[stat])
+}
+
+// Error counts err against the stage that raised it, errors that are not
+// StageErrors are not counted.
+func (s *Stats) Error(err error) {
+	if s == nil {
+		return
+	}
+
+	if stageErr, ok := err.(*StageError); ok {
+		if n := stageIndex(stageErr.Stage); n >= 0 {
+			atomic.AddInt64(&s.stageErrors[n], 1)
+		}
+	}
+}
+
+// timed counts a call of stage and the time it took.
+func (s *Stats) timed(stage string, took time.Duration) {
+	if n := stageIndex(stage); n >= 0 {
+		atomic.AddInt64(&s.stageCalls[n], 1)
+		atomic.AddInt64(&s.stageTime[n], int64(took))
+	}
+}
+
+func stageIndex(stage string) int {
+	for n, name := range stageNames {
+		if name == stage {
+			return n
+		}
+	}
+	return -1
+}
+
+// StageReport is the part of a StatsReport about a single stage.
+type StageReport struct {
+	Calls  int64   `json:"calls"`
+	Errors int64   `json:"errors"`
+	TimeMs float64 `json:"time_ms"`
+}
+
+// StatsReport is a snapshot of Stats, encoded for --stats-json.
+type StatsReport struct {
+	ElapsedMs float64                `json:"elapsed_ms"`
+	Counts    map[string]int64       `json:"counts"`
+	Stages    map[string]StageReport `json:"stages"`
+}
+
+func (s *Stats) Report() StatsReport {
+	report := StatsReport{
+		ElapsedMs: milliseconds(time.Since(s.start)),
+		Counts:    make(map[string]int64),
+		Stages:    make(map[string]StageReport),
+	}
+
+	for stat, name := range statNames {
+		report.Counts[name] = s.Count(stat)
+	}
+
+	for n, name := range stageNames {
+		calls := atomic.LoadInt64(&s.stageCalls[n])
+		errors := atomic.LoadInt64(&s.stageErrors[n])
+		if calls == 0 && errors == 0 {
+			continue
+		}
+
+		report.Stages[name] = StageReport{
+			Calls:  calls,
+			Errors: errors,
+			TimeMs: milliseconds(time.Duration(atomic.LoadInt64(&s.stageTime[n]))),
+		}
+	}
+
+	return report
+}
+
+// WriteText writes the report as a short table for people.
+func (r StatsReport) WriteText(w io.Writer) error {
+	c := r.Counts
+	_, err := fmt.Fprintf(w,
+		"rows: %d read, %d parse errors, %d filtered, %d deduped, %d failed, %d emitted in %.1fms\n",
+		c["rows"], c["parse_errors"], c["filtered"], c["deduped"], c["failed"], c["emitted"], r.ElapsedMs,
+	)
+	if err != nil || len(r.Stages) == 0 {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%-8s %10s %8s %12s\n", "stage", "calls", "errors", "time")
+	for _, name := range stageNames {
+		stage, found := r.Stages[name]
+		if !found || err != nil {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "%-8s %10d %8d %10.1fms\n", name, stage.Calls, stage.Errors, stage.TimeMs)
+	}
+	return err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
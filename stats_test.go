@@ -0,0 +1,94 @@
+package jsl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStats(t *testing.T) {
+	run_stats := NewStats()
+
+	ch := make(chan Record, 10)
+	err := ReadJsonObjectsWithOptions(ch, strings.NewReader("{\"a\": 1}\n{\"a\": 2}\nnope\n{\"a\": 2}\n{\"a\": 3}\n{}\n"), ReadOptions{Stats: run_stats})
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+
+	iter, _ := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {},
+		Filter:  "i.a != 1",
+		Dedupe:  "i.a",
+		Iter:    "i.a.toFixed(1)",
+		Stats:   run_stats,
+	})
+
+	iter.PreIteration()
+	for rec := range ch {
+		run_stats.Error(iter.IterRecord(rec))
+	}
+	iter.PostIteration()
+
+	report := run_stats.Report()
+	expected := map[string]int64{
+		"rows": 5, "parse_errors": 1, "kept": 4, "filtered": 1, "filter_errors": 0,
+		"deduped": 1, "failed": 1, "ok": 4, "emitted": 2,
+	}
+	for name, count := range expected {
+		if report.Counts[name] != count {
+			t.Errorf("%s = %d, expected %d", name, report.Counts[name], count)
+		}
+	}
+
+	if stage := report.Stages["iter"]; stage.Calls != 3 || stage.Errors != 1 {
+		t.Errorf("Wrong iter stage stats: %+v", stage)
+	}
+
+	if _, found := report.Stages["accum"]; found {
+		t.Errorf("Stages that never ran should not be reported: %v", report.Stages)
+	}
+
+	var output bytes.Buffer
+	report.WriteText(&output)
+	if !strings.HasPrefix(output.String(), "rows: 5 read, 1 parse errors, 1 filtered, 1 deduped, 1 failed, 2 emitted") {
+		t.Errorf("Wrong summary: %q", output.String())
+	}
+}
+
+func TestStats_ParseErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		read   ReaderFunc
+		input  io.Reader
+		opts   ReadOptions
+		errors int64
+	}{
+		{"nested", Nested_ReadJsonObjectsWithOptions, strings.NewReader(`[1, 2] [nope]`), ReadOptions{}, 1},
+		{"nested scalar", Nested_ReadJsonObjectsWithOptions, strings.NewReader(`[1] 2`), ReadOptions{}, 1},
+		{"nested truncated", Nested_ReadJsonObjectsWithOptions, strings.NewReader(`[1, 2`), ReadOptions{}, 1},
+		{"nested path", Nested_ReadJsonObjectsWithOptions, strings.NewReader(`{"a": [1]} {"b": 2} {"a": [3]}`), ReadOptions{Path: "a"}, 1},
+		{"flatten", Flatten_ReadJsonObjectsWithOptions, strings.NewReader(`[1, [2, nope]]`), ReadOptions{}, 1},
+		{"flatten ok", Flatten_ReadJsonObjectsWithOptions, strings.NewReader(`[1, [2, [3]]]`), ReadOptions{}, 0},
+		{"input error", Nested_ReadJsonObjectsWithOptions, io.MultiReader(strings.NewReader(`[1, `), iotest.ErrReader(errors.New("disk"))), ReadOptions{}, 0},
+	}
+
+	for _, c := range cases {
+		c.opts.Stats = NewStats()
+
+		ch := make(chan Record, 10)
+		c.read(ch, c.input, c.opts)
+
+		if count := c.opts.Stats.Report().Counts["parse_errors"]; count != c.errors {
+			t.Errorf("%s: %d parse errors, expected %d", c.name, count, c.errors)
+		}
+	}
+}
+
+func TestStats_Nil(t *testing.T) {
+	var run_stats *Stats
+	run_stats.Add(RowsRead)
+	run_stats.Error(nil)
+}
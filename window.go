@@ -0,0 +1,310 @@
+package jsl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// WindowConfig makes an iterator run post at window boundaries instead of
+// once at the end, every window starts with its own accumulator from pre.
+// Windows are either Count rows long or Time long, rows that are filtered
+// out or deduped do not count.
+type WindowConfig struct {
+	Count int
+	Time  time.Duration
+
+	// A new window starts every CountSlide rows or TimeSlide, windows
+	// overlap when this is shorter than the window. Zero gives tumbling
+	// windows that start when the previous one ends.
+	CountSlide int
+	TimeSlide  time.Duration
+
+	// Timestamp is an expression for the time of a row (i), a Date,
+	// a date string or milliseconds since the epoch. Time windows use
+	// the wall clock when it is empty.
+	Timestamp string
+}
+
+func (wc WindowConfig) Enabled() bool {
+	return wc.Count > 0 || wc.Time > 0
+}
+
+// WallClock is true for time windows that close by the wall clock and
+// need WindowTick to be called while no rows come in.
+func (wc WindowConfig) WallClock() bool {
+	return wc.Time > 0 && len(wc.Timestamp) == 0
+}
+
+// TickInterval is how often WindowTick should be called for wall clock
+// windows, a tenth of the slide between 10ms and a second.
+func (wc WindowConfig) TickInterval() time.Duration {
+	slide := wc.TimeSlide
+	if slide <= 0 {
+		slide = wc.Time
+	}
+
+	interval := slide / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	} else if interval > time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Validate checks the window settings make sense together.
+func (wc WindowConfig) Validate() error {
+	if wc.Count < 0 || wc.Time < 0 || wc.CountSlide < 0 || wc.TimeSlide < 0 {
+		return errors.New("window sizes must be positive")
+	}
+	if wc.Time > 0 && wc.Time < time.Millisecond {
+		return errors.New("window time must be at least a millisecond")
+	}
+	if wc.Count > 0 && wc.Time > 0 {
+		return errors.New("window by count or by time, not both")
+	}
+	if len(wc.Timestamp) > 0 && wc.Time == 0 {
+		return errors.New("window timestamp needs a window time")
+	}
+	if wc.CountSlide > 0 && wc.Count == 0 || wc.TimeSlide > 0 && wc.Time == 0 {
+		return errors.New("window slide needs a window of the same kind")
+	}
+	if wc.CountSlide > wc.Count || wc.TimeSlide > wc.Time {
+		return errors.New("window slide must not be longer than the window")
+	}
+	return nil
+}
+
+// window is a single window, start and end are row numbers for count
+// windows and milliseconds since the epoch for time windows.
+type window struct {
+	start int64
+	end   int64
+	accum goja.Value
+}
+
+type windowState struct {
+	size      int64
+	slide     int64
+	byCount   bool
+	wallClock bool
+
+	// Open windows sorted by start, all windows have the same size so
+	// they are sorted by end too.
+	open []*window
+
+	// Windows ending at or before watermark have been emitted.
+	watermark int64
+	rows      int64
+
+	timestampFunc goja.Callable
+}
+
+func (it *GojaIterator) setupWindow(wc WindowConfig) error {
+	err := wc.Validate()
+	if err != nil {
+		return err
+	}
+
+	ws := &windowState{
+		watermark: math.MinInt64,
+		wallClock: wc.WallClock(),
+	}
+
+	if wc.Count > 0 {
+		ws.byCount = true
+		ws.size = int64(wc.Count)
+		ws.slide = int64(wc.CountSlide)
+	} else {
+		ws.size = wc.Time.Milliseconds()
+		ws.slide = wc.TimeSlide.Milliseconds()
+	}
+
+	if ws.slide < 1 {
+		ws.slide = ws.size
+	}
+
+	if len(wc.Timestamp) > 0 {
+		err := it.defineStage("window", `function window_time(i) {
+  var t = (`, wc.Timestamp, `);
+  if (t instanceof Date) { return t.getTime() }
+  if (typeof t === "string") { return Date.parse(t) }
+  return Number(t);
+}`)
+		if err != nil {
+			return err
+		}
+
+		fn, ok := goja.AssertFunction(it.VM.Get("window_time"))
+		if !ok {
+			return errors.New("window_time is not a function")
+		}
+		ws.timestampFunc = fn
+	}
+
+	it.window = ws
+	return nil
+}
+
+// windowRow adds the row to every open window it falls in, opening them
+// when needed, and emits the windows it closes.
+func (it *GojaIterator) windowRow(row goja.Value) error {
+	ws := it.window
+
+	var t int64
+	if ws.byCount {
+		t = ws.rows
+	} else if ws.timestampFunc != nil {
+		value, err := it.call("window", ws.timestampFunc, row)
+		if err != nil {
+			return err
+		}
+
+		ms := value.ToFloat()
+		if math.IsNaN(ms) || math.IsInf(ms, 0) {
+			return atStage("window", fmt.Errorf("invalid window timestamp %s", value))
+		}
+		t = int64(ms)
+	} else {
+		t = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	// Time windows end when a later row shows up, count windows once
+	// their last row is in.
+	if !ws.byCount {
+		err := it.closeWindows(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := it.openWindows(t)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range ws.open {
+		if !it.hasAccumulator || w.start > t || w.end <= t {
+			continue
+		}
+
+		newAccum, err := it.accumulate(row, w.accum)
+		if err != nil {
+			return err
+		}
+		w.accum = newAccum
+	}
+
+	if len(ws.open) > 0 {
+		it.Accumulator = ws.open[len(ws.open)-1].accum
+	}
+
+	if ws.byCount {
+		ws.rows += 1
+		return it.closeWindows(ws.rows)
+	}
+
+	return nil
+}
+
+// openWindows makes sure every window holding t is open, windows that
+// were already emitted are not opened again so late rows are not
+// accumulated.
+func (it *GojaIterator) openWindows(t int64) error {
+	ws := it.window
+
+	first := floorDiv(t-ws.size, ws.slide) + 1
+	last := floorDiv(t, ws.slide)
+
+	for k := first; k <= last; k += 1 {
+		start := k * ws.slide
+		end := start + ws.size
+
+		if end <= ws.watermark || (ws.byCount && start < 0) {
+			continue
+		}
+
+		pos := 0
+		for pos < len(ws.open) && ws.open[pos].start < start {
+			pos += 1
+		}
+		if pos < len(ws.open) && ws.open[pos].start == start {
+			continue
+		}
+
+		accum, err := it.newAccumulator()
+		if err != nil {
+			return err
+		}
+
+		ws.open = append(ws.open, nil)
+		copy(ws.open[pos+1:], ws.open[pos:])
+		ws.open[pos] = &window{start: start, end: end, accum: accum}
+	}
+
+	return nil
+}
+
+// closeWindows emits post for every open window ending at or before until.
+func (it *GojaIterator) closeWindows(until int64) error {
+	ws := it.window
+
+	for len(ws.open) > 0 && ws.open[0].end <= until {
+		w := ws.open[0]
+		ws.open = ws.open[1:]
+
+		if w.end > ws.watermark {
+			ws.watermark = w.end
+		}
+
+		bounds := it.VM.NewObject()
+		bounds.Set("start", w.start)
+		bounds.Set("end", w.end)
+		it.meta.Set("window", bounds)
+
+		it.Accumulator = w.accum
+		_, err := it.post()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WindowTick closes the wall clock windows that ended before now and
+// opens the current ones, so empty windows are emitted too.
+func (it *GojaIterator) WindowTick(now time.Time) error {
+	if it.window == nil || !it.window.wallClock {
+		return nil
+	}
+
+	t := now.UnixNano() / int64(time.Millisecond)
+
+	err := it.closeWindows(t)
+	if err != nil {
+		return err
+	}
+
+	err = it.openWindows(t)
+	if err != nil {
+		return err
+	}
+
+	if len(it.window.open) > 0 {
+		it.Accumulator = it.window.open[len(it.window.open)-1].accum
+	}
+	return nil
+}
+
+func floorDiv(a int64, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q -= 1
+	}
+	return q
+}
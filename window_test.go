@@ -0,0 +1,143 @@
+package jsl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// runWindows feeds rows through an iterator and returns what it emitted.
+func runWindows(t *testing.T, ic *IterConfig, rows []interface{}) []interface{} {
+	var results []interface{}
+	ic.Emitter = func(i interface{}) {
+		results = append(results, i.(goja.Value).Export())
+	}
+
+	iter, err := NewIterator(ic)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %s", err)
+	}
+
+	iter.PreIteration()
+	for _, row := range rows {
+		if err := iter.IterFunc(row); err != nil {
+			t.Fatalf("Iteration failed: %s", err)
+		}
+	}
+	if err := iter.PostIteration(); err != nil {
+		t.Fatalf("Post failed: %s", err)
+	}
+
+	return results
+}
+
+func TestWindow_Count(t *testing.T) {
+	rows := []interface{}{1, 2, 3, 4, 5, 6, 7}
+
+	tumbling := runWindows(t, &IterConfig{
+		Pre:         "{sum:0}",
+		Accumulator: "accum.sum+=i",
+		Post:        "accum.sum",
+		Filter:      "i != 4",
+		Iter:        "undefined",
+		Window:      WindowConfig{Count: 2},
+	}, rows)
+
+	if !reflect.DeepEqual(tumbling, []interface{}{int64(3), int64(8), int64(13)}) {
+		t.Errorf("Tumbling windows incorrect: %v", tumbling)
+	}
+
+	sliding := runWindows(t, &IterConfig{
+		Pre:         "[]",
+		Accumulator: "accum.push(i)",
+		Post:        "meta.window.start + ':' + accum.join(',')",
+		Iter:        "undefined",
+		Window:      WindowConfig{Count: 3, CountSlide: 2},
+	}, rows)
+
+	expected := []interface{}{"0:1,2,3", "2:3,4,5", "4:5,6,7", "6:7"}
+	if !reflect.DeepEqual(sliding, expected) {
+		t.Errorf("Sliding windows incorrect: %v", sliding)
+	}
+}
+
+func TestWindow_Timestamp(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{"ts": 1000, "n": 1},
+		map[string]interface{}{"ts": 9999, "n": 2},
+		map[string]interface{}{"ts": "1970-01-01T00:00:12Z", "n": 3},
+		// Late, its window was already emitted.
+		map[string]interface{}{"ts": 5000, "n": 100},
+		map[string]interface{}{"ts": 35000, "n": 4},
+	}
+
+	results := runWindows(t, &IterConfig{
+		Pre:         "{sum:0}",
+		Accumulator: "accum.sum+=i.n",
+		Post:        "meta.window.start + '=' + accum.sum",
+		Iter:        "undefined",
+		Window:      WindowConfig{Time: 10 * time.Second, Timestamp: "i.ts"},
+	}, rows)
+
+	expected := []interface{}{"0=3", "10000=3", "30000=4"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Time windows incorrect: %v", results)
+	}
+
+	sliding := runWindows(t, &IterConfig{
+		Pre:         "{sum:0}",
+		Accumulator: "accum.sum+=i.n",
+		Post:        "meta.window.start + '=' + accum.sum",
+		Iter:        "undefined",
+		Window:      WindowConfig{Time: 10 * time.Second, TimeSlide: 5 * time.Second, Timestamp: "new Date(i.ts)"},
+	}, rows[:3])
+
+	expected = []interface{}{"-5000=1", "0=3", "5000=5", "10000=3"}
+	if !reflect.DeepEqual(sliding, expected) {
+		t.Errorf("Sliding time windows incorrect: %v", sliding)
+	}
+}
+
+func TestWindow_WallClock(t *testing.T) {
+	var results []interface{}
+
+	iter, err := NewIterator(&IterConfig{
+		Emitter: func(i interface{}) {
+			results = append(results, i.(goja.Value).Export())
+		},
+		Pre:         "{count:0}",
+		Accumulator: "accum.count+=1",
+		Post:        "accum.count",
+		Window:      WindowConfig{Time: time.Second},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %s", err)
+	}
+
+	// Windows with no rows are emitted as well.
+	start := time.Unix(100, 0)
+	iter.WindowTick(start)
+	iter.WindowTick(start.Add(1500 * time.Millisecond))
+	iter.WindowTick(start.Add(2500 * time.Millisecond))
+
+	if !reflect.DeepEqual(results, []interface{}{int64(0), int64(0)}) {
+		t.Errorf("Empty windows incorrect: %v", results)
+	}
+}
+
+func TestWindow_Invalid(t *testing.T) {
+	configs := []WindowConfig{
+		{Count: 2, Time: time.Second},
+		{Count: 2, CountSlide: 3},
+		{Count: 2, TimeSlide: time.Second},
+		{Count: 2, Timestamp: "i.ts"},
+	}
+
+	for _, wc := range configs {
+		if _, err := NewIterator(&IterConfig{Window: wc}); err == nil {
+			t.Errorf("Expected an error for %+v", wc)
+		}
+	}
+}